@@ -0,0 +1,379 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/knadh/koanf/providers/confmap"
+)
+
+// StdinPath stands for stdin in the paths given to LoadFromPaths.
+const StdinPath = "-"
+
+// includeKey is the top-level key listing the files included by a config
+// file.
+const includeKey = "include"
+
+// configLoader reads config files, following includes, and merges them.
+type configLoader struct {
+	stdin       io.Reader
+	stdinFormat string
+	values      map[string]any
+	// origins holds the source that set each value, by path.
+	origins map[string]string
+	// loaded holds the absolute paths of the files loaded so far.
+	loaded []string
+}
+
+// LoadFromPaths loads the config from files, directories and stdin, and
+// merges them. A directory stands for the *.toml, *.yaml, *.yml and *.json
+// files in it, in lexical order, and "-" for stdin, read in stdinFormat.
+//
+// A file may include others by listing their paths, which may be directories
+// or glob patterns relative to the file, under the top-level include key.
+// Files already loaded are not loaded again.
+//
+// Values set in several files must be equal. Lists of named entries, such as
+// users and databases, are merged by name, and entries with the same name are
+// merged likewise. Other lists are concatenated, without duplicates.
+func LoadFromPaths(paths []string, stdin io.Reader, stdinFormat string) (*Main, error) {
+	if len(paths) == 0 {
+		return nil, errors.New("no config files specified")
+	}
+	l := &configLoader{
+		stdin:       stdin,
+		stdinFormat: stdinFormat,
+		values:      make(map[string]any),
+		origins:     make(map[string]string),
+	}
+	for _, path := range paths {
+		err := l.loadPath(path, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return Load(confmap.Provider(l.values, ""), nil)
+}
+
+// loadPath loads a file, a directory of files, or stdin. stack holds the
+// files including it.
+func (l *configLoader) loadPath(path string, stack []string) error {
+	if path == StdinPath {
+		if l.stdin == nil {
+			return errors.New("reading the config from stdin is not supported")
+		}
+		if l.stdinFormat == "" {
+			return errors.New("the config format must be specified when reading the config from stdin")
+		}
+		data, err := io.ReadAll(l.stdin)
+		if err != nil {
+			return err
+		}
+		return l.loadData(data, l.stdinFormat, "stdin", ".", stack)
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !stat.IsDir() {
+		return l.loadFile(path, stack)
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	count := 0
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		_, err = FormatFromPath(entry.Name())
+		if err != nil {
+			continue
+		}
+		err = l.loadFile(filepath.Join(path, entry.Name()), stack)
+		if err != nil {
+			return err
+		}
+		count++
+	}
+	if count == 0 {
+		return fmt.Errorf("no config files in directory %s", path)
+	}
+	return nil
+}
+
+// loadFile loads a config file, unless it has already been loaded.
+func (l *configLoader) loadFile(path string, stack []string) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if slices.Contains(stack, absPath) {
+		return fmt.Errorf("%s includes itself", path)
+	}
+	if slices.Contains(l.loaded, absPath) {
+		return nil
+	}
+	l.loaded = append(l.loaded, absPath)
+
+	format, err := FormatFromPath(path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return l.loadData(data, format, path, filepath.Dir(path), append(stack, absPath))
+}
+
+// loadData parses a config and merges it, and then loads the files it
+// includes, relative to dir.
+func (l *configLoader) loadData(data []byte, format string, source string, dir string, stack []string) error {
+	parser, err := getParser(format)
+	if err != nil {
+		return err
+	}
+	values, err := parser.Unmarshal(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", source, err)
+	}
+
+	includes, err := includePaths(values[includeKey])
+	if err != nil {
+		return fmt.Errorf("%s: %w", source, err)
+	}
+	delete(values, includeKey)
+
+	err = l.mergeMap(l.values, values, "", source)
+	if err != nil {
+		return err
+	}
+
+	for _, include := range includes {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(dir, include)
+		}
+		matches := []string{include}
+		if strings.ContainsAny(include, "*?[") {
+			matches, err = filepath.Glob(include)
+			if err != nil {
+				return fmt.Errorf("%s: %w", source, err)
+			}
+			if len(matches) == 0 {
+				return fmt.Errorf("%s: no files match %s", source, include)
+			}
+		}
+		for _, match := range matches {
+			err = l.loadPath(match, stack)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// includePaths returns the paths listed under the include key, which may be a
+// string or a list of strings.
+func includePaths(value any) ([]string, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return []string{v}, nil
+	case []any:
+		paths := make([]string, 0, len(v))
+		for _, item := range v {
+			path, ok := item.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s must be a list of paths", includeKey)
+			}
+			paths = append(paths, path)
+		}
+		return paths, nil
+	}
+	return nil, fmt.Errorf("%s must be a list of paths", includeKey)
+}
+
+// mergeMap merges the values of src into dst. Conflict errors name the path
+// of the value and the sources that set it, but never the values, which may
+// be secrets.
+func (l *configLoader) mergeMap(dst map[string]any, src map[string]any, path string, source string) error {
+	for key, value := range src {
+		keyPath := key
+		if path != "" {
+			keyPath = path + "." + key
+		}
+		current, ok := dst[key]
+		if !ok {
+			dst[key] = value
+			l.setOrigin(value, keyPath, source)
+			continue
+		}
+
+		currentMap, currentIsMap := current.(map[string]any)
+		valueMap, valueIsMap := value.(map[string]any)
+		currentList, currentIsList := current.([]any)
+		valueList, valueIsList := value.([]any)
+		switch {
+		case currentIsMap && valueIsMap:
+			err := l.mergeMap(currentMap, valueMap, keyPath, source)
+			if err != nil {
+				return err
+			}
+		case currentIsList && valueIsList:
+			merged, err := l.mergeList(currentList, valueList, keyPath, source)
+			if err != nil {
+				return err
+			}
+			dst[key] = merged
+		case !sameValue(current, value):
+			origin := l.origins[keyPath]
+			if origin == "" {
+				origin = "an earlier file"
+			}
+			return fmt.Errorf("conflicting values for %s in %s and %s", keyPath, origin, source)
+		}
+	}
+	return nil
+}
+
+// mergeList merges the items of src into dst. If either list holds entries
+// with a name, entries are merged by name, and plain strings stand for
+// entries with just a name, as in the users of a database. Other items are
+// appended unless already present.
+func (l *configLoader) mergeList(dst []any, src []any, path string, source string) ([]any, error) {
+	if !slices.ContainsFunc(dst, isNamedEntry) && !slices.ContainsFunc(src, isNamedEntry) {
+		for _, item := range src {
+			if !slices.ContainsFunc(dst, func(existing any) bool {
+				return sameValue(existing, item)
+			}) {
+				dst = append(dst, item)
+			}
+		}
+		return dst, nil
+	}
+
+	for _, item := range src {
+		entry, ok := namedEntry(item)
+		if !ok {
+			return nil, fmt.Errorf("%s in %s: entries must have a name", path, source)
+		}
+		name := entry["name"].(string)
+		entryPath := fmt.Sprintf("%s[%s]", path, name)
+		i := slices.IndexFunc(dst, func(existing any) bool {
+			existingEntry, ok := namedEntry(existing)
+			return ok && (existingEntry["name"] == name)
+		})
+		if i < 0 {
+			dst = append(dst, item)
+			l.setOrigin(entry, entryPath, source)
+			continue
+		}
+		existing, _ := namedEntry(dst[i])
+		err := l.mergeMap(existing, entry, entryPath, source)
+		if err != nil {
+			return nil, err
+		}
+		dst[i] = existing
+	}
+	return dst, nil
+}
+
+// setOrigin records the source of a value and of the values nested in it.
+func (l *configLoader) setOrigin(value any, path string, source string) {
+	l.origins[path] = source
+	switch v := value.(type) {
+	case map[string]any:
+		for key, item := range v {
+			l.setOrigin(item, path+"."+key, source)
+		}
+	case []any:
+		for _, item := range v {
+			if isNamedEntry(item) {
+				entry := item.(map[string]any)
+				l.setOrigin(entry, fmt.Sprintf("%s[%s]", path, entry["name"]), source)
+			}
+		}
+	}
+}
+
+// sameValue reports whether two values read from config files are equal,
+// whatever the format they were read from: TOML reads integers as int64,
+// YAML as int, and JSON reads all numbers as float64.
+func sameValue(a any, b any) bool {
+	return reflect.DeepEqual(normalizeValue(a), normalizeValue(b))
+}
+
+// normalizeValue converts the integers and integral floats in a value to
+// int64, other floats to float64 and durations to strings, recursively.
+func normalizeValue(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		m := make(map[string]any, len(v))
+		for key, item := range v {
+			m[key] = normalizeValue(item)
+		}
+		return m
+	case []any:
+		items := make([]any, len(v))
+		for i, item := range v {
+			items[i] = normalizeValue(item)
+		}
+		return items
+	case time.Duration:
+		return v.String()
+	}
+
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if rv.Uint() <= math.MaxInt64 {
+			return int64(rv.Uint())
+		}
+		return rv.Uint()
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		if (f == math.Trunc(f)) && (math.Abs(f) < (1 << 53)) {
+			return int64(f)
+		}
+		return f
+	}
+	return value
+}
+
+// isNamedEntry reports whether the item is a map with a string name.
+func isNamedEntry(item any) bool {
+	m, ok := item.(map[string]any)
+	if !ok {
+		return false
+	}
+	_, ok = m["name"].(string)
+	return ok
+}
+
+// namedEntry returns the item as a map with a name, converting a plain string
+// to an entry with just a name.
+func namedEntry(item any) (map[string]any, bool) {
+	switch v := item.(type) {
+	case string:
+		return map[string]any{"name": v}, true
+	case map[string]any:
+		_, ok := v["name"].(string)
+		return v, ok
+	}
+	return nil, false
+}
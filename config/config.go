@@ -4,39 +4,176 @@ import (
 	"errors"
 	"fmt"
 	"os"
-	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/go-playground/validator"
 	"github.com/knadh/koanf"
-	"github.com/knadh/koanf/parsers/json"
-	"github.com/knadh/koanf/parsers/toml"
-	"github.com/knadh/koanf/parsers/yaml"
-	"github.com/knadh/koanf/providers/file"
 	"github.com/mitchellh/mapstructure"
 )
 
+// MaxIdentifierLength is the maximum length in bytes of a PostgreSQL identifier.
+const MaxIdentifierLength = 63
+
+const (
+	StatePresent = "present"
+	StateAbsent  = "absent"
+)
+
 type Main struct {
-	Database  string      `koanf:"database"`
-	User      string      `koanf:"user" validate:"required"`
+	Database  string      `koanf:"database" validate:"omitempty,identifier"`
+	User      string      `koanf:"user" validate:"required,identifier"`
 	Host      string      `koanf:"host"`
 	Port      int         `koanf:"port"`
 	SslMode   string      `koanf:"sslmode"`
 	SshProxy  string      `koanf:"sshProxy"`
 	Users     []*User     `koanf:"users" validate:"dive"`
+	Groups    []*Group    `koanf:"groups" validate:"dive"`
+	Profiles  []*Profile  `koanf:"profiles" validate:"dive"`
 	Databases []*Database `koanf:"databases" validate:"dive"`
+	Prune     Prune       `koanf:"prune"`
+	Lock      Lock        `koanf:"lock"`
+
+	// AllowMD5Passwords allows MD5 password verifiers in passwords, and for
+	// servers older than PostgreSQL 10, which do not support SCRAM-SHA-256.
+	AllowMD5Passwords bool `koanf:"allowMd5Passwords"`
+
+	// ConnectTimeout bounds establishing the ssh proxy and each database
+	// connection. Zero waits indefinitely.
+	ConnectTimeout time.Duration `koanf:"connectTimeout" validate:"min=0"`
+	// StatementTimeout is set as the statement_timeout of each database
+	// session. Zero uses the server default.
+	StatementTimeout time.Duration `koanf:"statementTimeout" validate:"min=0"`
+}
+
+// Prune configures the removal of roles and databases that are not declared.
+// Ignore lists may contain glob patterns.
+type Prune struct {
+	IgnoreRoles     []string `koanf:"ignoreRoles"`
+	IgnoreDatabases []string `koanf:"ignoreDatabases"`
+}
+
+// Lock configures the advisory lock taken by provision runs, so that runs
+// against the same server do not interleave.
+type Lock struct {
+	// Key is the advisory lock key. Zero uses the default key.
+	Key int64 `koanf:"key"`
+	// Database is the database the lock is taken in. Advisory locks are
+	// scoped to a database, so only runs using the same lock database exclude
+	// each other. Empty uses the admin database.
+	Database string `koanf:"database" validate:"omitempty,identifier"`
+	// Timeout is how long to wait for a run holding the lock to finish. Zero
+	// uses the default timeout, and a negative timeout fails at once.
+	Timeout time.Duration `koanf:"timeout"`
 }
 
 type User struct {
-	Name     string `koanf:"name" validate:"required"`
+	Name     string `koanf:"name" validate:"required,rolename"`
 	Password string `koanf:"password"`
+	// PasswordFile, PasswordEnv, PasswordCommand and PasswordFrom read the
+	// password from a file, an environment variable, the output of a shell
+	// command, or a registered password provider given as "name:ref". At
+	// most one of them and Password may be specified.
+	PasswordFile    string `koanf:"passwordFile"`
+	PasswordEnv     string `koanf:"passwordEnv"`
+	PasswordCommand string `koanf:"passwordCommand"`
+	PasswordFrom    string `koanf:"passwordFrom"`
+	// TrimPassword trims surrounding whitespace, such as a trailing newline,
+	// from passwords read from other sources than Password. It defaults to
+	// true.
+	TrimPassword    *bool    `koanf:"trimPassword"`
+	Login           *bool    `koanf:"login"`
+	Superuser       *bool    `koanf:"superuser"`
+	CreateDB        *bool    `koanf:"createdb"`
+	CreateRole      *bool    `koanf:"createrole"`
+	Inherit         *bool    `koanf:"inherit"`
+	Replication     *bool    `koanf:"replication"`
+	BypassRLS       *bool    `koanf:"bypassrls"`
+	ConnectionLimit *int     `koanf:"connectionLimit" validate:"omitempty,min=-1"`
+	ValidUntil      string   `koanf:"validUntil"`
+	Settings        Settings `koanf:"settings"`
+	State           string   `koanf:"state" validate:"omitempty,oneof=present absent"`
+}
+
+// Settings are runtime settings, such as search_path or statement_timeout.
+// Settings that are not specified at all are left unchanged, but once
+// specified, settings not listed are reset.
+type Settings map[string]string
+
+type Group struct {
+	Name    string    `koanf:"name" validate:"required,rolename"`
+	Members []*Member `koanf:"members" validate:"dive"`
+}
+
+type Member struct {
+	Name    string `koanf:"name" validate:"required,identifier"`
+	Admin   bool   `koanf:"admin"`
+	Inherit *bool  `koanf:"inherit"`
+	Set     *bool  `koanf:"set"`
+}
+
+// Profile is a named set of privileges that can be granted to database users.
+type Profile struct {
+	Name      string   `koanf:"name" validate:"required"`
+	Schema    []string `koanf:"schema" validate:"dive,oneof=USAGE CREATE"`
+	Tables    []string `koanf:"tables" validate:"dive,oneof=SELECT INSERT UPDATE DELETE TRUNCATE REFERENCES TRIGGER MAINTAIN"`
+	Sequences []string `koanf:"sequences" validate:"dive,oneof=USAGE SELECT UPDATE"`
 }
 
 type Database struct {
-	Name  string   `koanf:"name" validate:"required"`
-	Owner string   `koanf:"owner" validate:"required"`
-	Users []string `koanf:"users"`
+	Name       string          `koanf:"name" validate:"required,identifier"`
+	Owner      string          `koanf:"owner" validate:"required,rolename"`
+	Users      []*DatabaseUser `koanf:"users" validate:"dive"`
+	Schemas    []*Schema       `koanf:"schemas" validate:"dive"`
+	Extensions []*Extension    `koanf:"extensions" validate:"dive"`
+	Settings   Settings        `koanf:"settings"`
+	State      string          `koanf:"state" validate:"omitempty,oneof=present absent"`
+	Protected  bool            `koanf:"protected"`
+
+	Template         string `koanf:"template" validate:"omitempty,identifier"`
+	Encoding         string `koanf:"encoding"`
+	LcCollate        string `koanf:"lcCollate"`
+	LcCtype          string `koanf:"lcCtype"`
+	LocaleProvider   string `koanf:"localeProvider" validate:"omitempty,oneof=libc icu builtin"`
+	IcuLocale        string `koanf:"icuLocale"`
+	Tablespace       string `koanf:"tablespace" validate:"omitempty,identifier"`
+	ConnectionLimit  *int   `koanf:"connectionLimit" validate:"omitempty,min=-1"`
+	IsTemplate       *bool  `koanf:"isTemplate"`
+	AllowConnections *bool  `koanf:"allowConnections"`
+}
+
+// Extension is an extension installed in a database. An empty Schema or
+// Version uses the server default.
+type Extension struct {
+	Name    string `koanf:"name" validate:"required,identifier"`
+	Schema  string `koanf:"schema" validate:"omitempty,identifier"`
+	Version string `koanf:"version"`
+}
+
+// Schema is a schema managed within a database. Database users are granted
+// their profile in every managed schema, unless overridden by the schema.
+type Schema struct {
+	Name                 string          `koanf:"name" validate:"required,identifier"`
+	Owner                string          `koanf:"owner" validate:"omitempty,rolename"`
+	Users                []*DatabaseUser `koanf:"users" validate:"dive"`
+	DefaultPrivilegesFor []string        `koanf:"defaultPrivilegesFor" validate:"dive,rolename"`
+}
+
+// DatabaseUser is a user granted privileges in a database. In config files, a
+// plain string is accepted as the name of a user with the default profile.
+type DatabaseUser struct {
+	Name     string   `koanf:"name" validate:"required,identifier"`
+	Profile  string   `koanf:"profile"`
+	Settings Settings `koanf:"settings"`
 }
 
+// Load reads the config from the provider. References to environment
+// variables in string values, such as ${PGPASSWORD} or ${PGHOST:-localhost},
+// are expanded, and then encrypted values are decrypted with the key from
+// LoadKey.
 func Load(provider koanf.Provider, parser koanf.Parser) (*Main, error) {
 	k := koanf.New(".")
 
@@ -50,6 +187,13 @@ func Load(provider koanf.Provider, parser koanf.Parser) (*Main, error) {
 	err = k.UnmarshalWithConf("", &cfg, koanf.UnmarshalConf{
 		Tag: "koanf",
 		DecoderConfig: &mapstructure.DecoderConfig{
+			DecodeHook: mapstructure.ComposeDecodeHookFunc(
+				interpolateEnvHookFunc,
+				decryptHookFunc(sync.OnceValues(LoadKey)),
+				stringToDatabaseUserHookFunc,
+				mapToSettingsHookFunc,
+				mapstructure.StringToTimeDurationHookFunc(),
+			),
 			Result:      &cfg,
 			ErrorUnused: true,
 			ErrorUnset:  false,
@@ -60,42 +204,123 @@ func Load(provider koanf.Provider, parser koanf.Parser) (*Main, error) {
 	}
 
 	validate := validator.New()
+	err = validate.RegisterValidation("identifier", validateIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	err = validate.RegisterValidation("rolename", validateRoleName)
+	if err != nil {
+		return nil, err
+	}
 	err = validate.Struct(&cfg)
 	if err != nil {
 		return nil, err
 	}
+	for _, user := range cfg.Users {
+		err = user.validatePasswordSource()
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, database := range cfg.Databases {
+		if database.IsAbsent() && database.Protected {
+			return nil, fmt.Errorf("database %s is protected and cannot be declared absent", database.Name)
+		}
+	}
 
 	return &cfg, nil
 }
 
+// LoadFromFile loads the config from a file, or a directory of files, and the
+// files they include, see LoadFromPaths.
 func LoadFromFile(path string) (*Main, error) {
-	stat, err := os.Stat(path)
-	if err != nil {
-		return nil, err
+	return LoadFromPaths([]string{path}, nil, "")
+}
+
+// validateIdentifier rejects names that PostgreSQL would reject or truncate.
+func validateIdentifier(fl validator.FieldLevel) bool {
+	name := fl.Field().String()
+	return (name != "") && (len(name) <= MaxIdentifierLength) && !strings.ContainsRune(name, 0)
+}
+
+// reservedRoleNames are the names that cannot be used for roles, besides
+// names starting with pg_.
+var reservedRoleNames = []string{"public", "none", "current_user", "session_user", "current_role"}
+
+// validateRoleName rejects role names that PostgreSQL would reject, including
+// reserved role names.
+func validateRoleName(fl validator.FieldLevel) bool {
+	name := fl.Field().String()
+	return validateIdentifier(fl) && !strings.HasPrefix(name, "pg_") && !slices.Contains(reservedRoleNames, name)
+}
+
+func stringToDatabaseUserHookFunc(f reflect.Type, t reflect.Type, data any) (any, error) {
+	if f.Kind() != reflect.String {
+		return data, nil
 	}
-	if stat.IsDir() {
-		return nil, os.ErrNotExist
+	if (t != reflect.TypeOf(DatabaseUser{})) && (t != reflect.TypeOf(&DatabaseUser{})) {
+		return data, nil
 	}
-	parser, err := getParserFromPath(path)
-	if err != nil {
-		return nil, err
+	return map[string]any{
+		"name": data,
+	}, nil
+}
+
+// mapToSettingsHookFunc flattens setting names containing dots, which koanf
+// splits into nested maps, and converts values to strings.
+func mapToSettingsHookFunc(f reflect.Type, t reflect.Type, data any) (any, error) {
+	if (t != reflect.TypeOf(Settings{})) || (f.Kind() != reflect.Map) {
+		return data, nil
+	}
+	m, ok := data.(map[string]any)
+	if !ok {
+		return data, nil
+	}
+	settings := make(Settings)
+	flattenSettings(settings, "", m)
+	return settings, nil
+}
+
+func flattenSettings(settings Settings, prefix string, m map[string]any) {
+	for key, value := range m {
+		if nested, ok := value.(map[string]any); ok {
+			flattenSettings(settings, prefix+key+".", nested)
+		} else {
+			settings[prefix+key] = fmt.Sprint(value)
+		}
 	}
-	return Load(file.Provider(path), parser)
 }
 
-func getParserFromPath(path string) (koanf.Parser, error) {
-	ext := filepath.Ext(path)
-	switch ext {
-	case ".toml":
-		return toml.Parser(), nil
-	case ".yaml":
-		return yaml.Parser(), nil
-	case ".yml":
-		return yaml.Parser(), nil
-	case ".json":
-		return json.Parser(), nil
+// validatePasswordSource checks that at most one password source is
+// specified.
+func (user *User) validatePasswordSource() error {
+	count := 0
+	for _, source := range []string{user.Password, user.PasswordFile, user.PasswordEnv, user.PasswordCommand, user.PasswordFrom} {
+		if source != "" {
+			count++
+		}
+	}
+	if count > 1 {
+		return fmt.Errorf("user %s: only one of password, passwordFile, passwordEnv, passwordCommand and passwordFrom may be specified", user.Name)
 	}
-	return nil, fmt.Errorf("unsupported file extension")
+	return nil
+}
+
+// HasPassword reports whether a password, or a source to read it from, is
+// specified.
+func (user *User) HasPassword() bool {
+	return (user.Password != "") || (user.PasswordFile != "") || (user.PasswordEnv != "") ||
+		(user.PasswordCommand != "") || (user.PasswordFrom != "")
+}
+
+// IsAbsent reports whether the user is declared absent, i.e. to be dropped.
+func (user *User) IsAbsent() bool {
+	return user.State == StateAbsent
+}
+
+// IsAbsent reports whether the database is declared absent, i.e. to be dropped.
+func (database *Database) IsAbsent() bool {
+	return database.State == StateAbsent
 }
 
 func (main *Main) GetUser(name string) *User {
@@ -109,3 +334,75 @@ func (main *Main) GetUser(name string) *User {
 	}
 	return nil
 }
+
+func (main *Main) GetGroup(name string) *Group {
+	if main.Groups == nil {
+		return nil
+	}
+	for _, group := range main.Groups {
+		if group.Name == name {
+			return group
+		}
+	}
+	return nil
+}
+
+func (main *Main) GetProfile(name string) *Profile {
+	if main.Profiles == nil {
+		return nil
+	}
+	for _, profile := range main.Profiles {
+		if profile.Name == name {
+			return profile
+		}
+	}
+	return nil
+}
+
+// DeclaresRole reports whether the role is declared as a user or group, or is
+// referenced by a database.
+func (main *Main) DeclaresRole(name string) bool {
+	if (main.GetUser(name) != nil) || (main.GetGroup(name) != nil) {
+		return true
+	}
+	for _, group := range main.Groups {
+		for _, member := range group.Members {
+			if member.Name == name {
+				return true
+			}
+		}
+	}
+	for _, database := range main.Databases {
+		if database.Owner == name {
+			return true
+		}
+		for _, user := range database.Users {
+			if user.Name == name {
+				return true
+			}
+		}
+		for _, schema := range database.Schemas {
+			if (schema.Owner == name) || slices.Contains(schema.DefaultPrivilegesFor, name) {
+				return true
+			}
+			for _, user := range schema.Users {
+				if user.Name == name {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (main *Main) GetDatabase(name string) *Database {
+	if main.Databases == nil {
+		return nil
+	}
+	for _, database := range main.Databases {
+		if database.Name == name {
+			return database
+		}
+	}
+	return nil
+}
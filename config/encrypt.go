@@ -0,0 +1,145 @@
+package config
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// EncryptedPrefix marks an encrypted config value.
+const EncryptedPrefix = "enc:"
+
+// Environment variables holding the key that encrypted config values are
+// decrypted with, or the path of a file containing it.
+const (
+	KeyEnv     = "PQ_PROVISIONER_KEY"
+	KeyFileEnv = "PQ_PROVISIONER_KEY_FILE"
+)
+
+const (
+	keyLength   = 32
+	nonceLength = 24
+)
+
+// Key is a key for encrypting config values with NaCl secretbox
+// (XSalsa20-Poly1305). It is written as base64.
+type Key [keyLength]byte
+
+// GenerateKey returns a random key.
+func GenerateKey() (*Key, error) {
+	var key Key
+	_, err := rand.Read(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// ParseKey parses a base64 key. Surrounding whitespace is ignored.
+func ParseKey(s string) (*Key, error) {
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+	if len(data) != keyLength {
+		return nil, fmt.Errorf("invalid key: expected %d bytes, got %d", keyLength, len(data))
+	}
+	var key Key
+	copy(key[:], data)
+	return &key, nil
+}
+
+// ReadKeyFile reads a base64 key from a file.
+func ReadKeyFile(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParseKey(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
+
+// LoadKey returns the key held by the PQ_PROVISIONER_KEY environment
+// variable, or read from the file named by PQ_PROVISIONER_KEY_FILE.
+func LoadKey() (*Key, error) {
+	s, ok := os.LookupEnv(KeyEnv)
+	if ok && (s != "") {
+		return ParseKey(s)
+	}
+	path, ok := os.LookupEnv(KeyFileEnv)
+	if ok && (path != "") {
+		return ReadKeyFile(path)
+	}
+	return nil, fmt.Errorf("no encryption key: neither %s nor %s is set", KeyEnv, KeyFileEnv)
+}
+
+func (key *Key) String() string {
+	return base64.StdEncoding.EncodeToString(key[:])
+}
+
+// Encrypt encrypts a value with the key, and returns it with the enc: prefix.
+func Encrypt(key *Key, value string) (string, error) {
+	var nonce [nonceLength]byte
+	_, err := rand.Read(nonce[:])
+	if err != nil {
+		return "", err
+	}
+	sealed := secretbox.Seal(nonce[:], []byte(value), &nonce, (*[keyLength]byte)(key))
+	return EncryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypts a value returned by Encrypt.
+func Decrypt(key *Key, value string) (string, error) {
+	encoded, ok := strings.CutPrefix(value, EncryptedPrefix)
+	if !ok {
+		return "", errors.New("value is not encrypted")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted value: %w", err)
+	}
+	if len(sealed) < nonceLength+secretbox.Overhead {
+		return "", errors.New("invalid encrypted value: too short")
+	}
+	var nonce [nonceLength]byte
+	copy(nonce[:], sealed[:nonceLength])
+	opened, ok := secretbox.Open(nil, sealed[nonceLength:], &nonce, (*[keyLength]byte)(key))
+	if !ok {
+		return "", errors.New("cannot decrypt value: wrong key or corrupted value")
+	}
+	return string(opened), nil
+}
+
+// IsEncrypted reports whether a value is encrypted.
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, EncryptedPrefix)
+}
+
+// decryptHookFunc returns a hook that decrypts encrypted string values, with
+// the key returned by loadKey. The key is only loaded if the config contains
+// encrypted values.
+func decryptHookFunc(loadKey func() (*Key, error)) func(f reflect.Type, t reflect.Type, data any) (any, error) {
+	return func(f reflect.Type, t reflect.Type, data any) (any, error) {
+		if f.Kind() != reflect.String {
+			return data, nil
+		}
+		s, ok := data.(string)
+		if !ok || !IsEncrypted(s) {
+			return data, nil
+		}
+		key, err := loadKey()
+		if err != nil {
+			return nil, err
+		}
+		return Decrypt(key, s)
+	}
+}
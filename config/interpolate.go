@@ -0,0 +1,84 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// interpolateEnvHookFunc expands references to environment variables in
+// string values, see interpolate.
+func interpolateEnvHookFunc(f reflect.Type, t reflect.Type, data any) (any, error) {
+	if f.Kind() != reflect.String {
+		return data, nil
+	}
+	s, ok := data.(string)
+	if !ok {
+		return data, nil
+	}
+	return interpolate(s, os.LookupEnv)
+}
+
+// interpolate expands ${VAR} to the value of the variable VAR, and
+// ${VAR:-default} to the value of VAR, or to default if VAR is unset or
+// empty. A reference to an unset variable without a default is an error. $${
+// stands for a literal ${, and a $ not followed by { is kept as is. Defaults
+// are taken literally, and cannot contain references or a closing brace.
+func interpolate(s string, lookup func(name string) (string, bool)) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if (i > 0) && (s[i-1] == '$') {
+			b.WriteString(s[:i-1])
+			b.WriteString("${")
+			s = s[i+2:]
+			continue
+		}
+		b.WriteString(s[:i])
+		s = s[i+2:]
+
+		end := strings.IndexByte(s, '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated variable reference ${%s", s)
+		}
+		reference := s[:end]
+		s = s[end+1:]
+
+		name, defaultValue, hasDefault := strings.Cut(reference, ":-")
+		if !isEnvName(name) {
+			return "", fmt.Errorf("invalid variable reference ${%s}", reference)
+		}
+		value, ok := lookup(name)
+		switch {
+		case hasDefault && (value == ""):
+			value = defaultValue
+		case !ok:
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		b.WriteString(value)
+	}
+}
+
+// isEnvName reports whether name is a valid environment variable name.
+func isEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case (c == '_') || ((c >= 'A') && (c <= 'Z')) || ((c >= 'a') && (c <= 'z')):
+		case (i > 0) && (c >= '0') && (c <= '9'):
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,115 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/knadh/koanf"
+	"github.com/knadh/koanf/parsers/json"
+	"github.com/knadh/koanf/parsers/toml"
+	"github.com/knadh/koanf/parsers/yaml"
+)
+
+// Formats are the supported config file formats.
+var Formats = []string{"toml", "yaml", "json"}
+
+// FormatFromPath returns the config file format for the extension of path.
+func FormatFromPath(path string) (string, error) {
+	switch filepath.Ext(path) {
+	case ".toml":
+		return "toml", nil
+	case ".yaml", ".yml":
+		return "yaml", nil
+	case ".json":
+		return "json", nil
+	}
+	return "", fmt.Errorf("unsupported file extension")
+}
+
+func getParser(format string) (koanf.Parser, error) {
+	switch format {
+	case "toml":
+		return toml.Parser(), nil
+	case "yaml":
+		return yaml.Parser(), nil
+	case "json":
+		return json.Parser(), nil
+	}
+	return nil, fmt.Errorf("unsupported format %s", format)
+}
+
+// Marshal serializes the config in the specified format. Empty values are
+// omitted.
+func Marshal(cfg *Main, format string) ([]byte, error) {
+	parser, err := getParser(format)
+	if err != nil {
+		return nil, err
+	}
+	return parser.Marshal(structToMap(reflect.ValueOf(cfg).Elem()))
+}
+
+func structToMap(v reflect.Value) map[string]any {
+	m := make(map[string]any)
+	for i := 0; i < v.NumField(); i++ {
+		key, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("koanf"), ",")
+		if key == "" {
+			continue
+		}
+		value := toMapValue(v.Field(i))
+		if value != nil {
+			m[key] = value
+		}
+	}
+	return m
+}
+
+// toMapValue converts a config value to the value stored in a koanf map, or
+// nil if it is empty. Pointers are only empty when nil, so that explicit false
+// and zero values are kept. Durations are written as strings such as "30s".
+func toMapValue(v reflect.Value) any {
+	if v.IsZero() {
+		return nil
+	}
+	if d, ok := v.Interface().(time.Duration); ok {
+		return d.String()
+	}
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.Elem().Kind() == reflect.Struct {
+			return toMapValue(v.Elem())
+		}
+		return v.Elem().Interface()
+	case reflect.Struct:
+		m := structToMap(v)
+		if len(m) == 0 {
+			return nil
+		}
+		return m
+	case reflect.Slice:
+		if v.Len() == 0 {
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Pointer {
+			maps := make([]map[string]any, 0, v.Len())
+			for i := 0; i < v.Len(); i++ {
+				maps = append(maps, structToMap(v.Index(i).Elem()))
+			}
+			return maps
+		}
+		values := make([]any, 0, v.Len())
+		for i := 0; i < v.Len(); i++ {
+			values = append(values, v.Index(i).Interface())
+		}
+		return values
+	case reflect.Map:
+		m := make(map[string]any)
+		for _, key := range v.MapKeys() {
+			m[key.String()] = v.MapIndex(key).Interface()
+		}
+		return m
+	}
+	return v.Interface()
+}
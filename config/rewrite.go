@@ -0,0 +1,194 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// encryptedValuePattern matches encrypted values in a config file.
+var encryptedValuePattern = regexp.MustCompile(regexp.QuoteMeta(EncryptedPrefix) + `[A-Za-z0-9+/]+=*`)
+
+// EncryptValues encrypts, in the text of a config file in the specified
+// format, the string values of the keys named in fields, such as "password".
+// Values that are empty, already encrypted or reference environment variables
+// are left alone. Only quoted values, and plain values in YAML, are found.
+// The rest of the text, including comments, is kept as is. It returns the new
+// text and the number of values encrypted.
+func EncryptValues(data []byte, format string, key *Key, fields []string) ([]byte, int, error) {
+	if len(fields) == 0 {
+		return data, 0, nil
+	}
+	names := make([]string, 0, len(fields))
+	for _, field := range fields {
+		names = append(names, regexp.QuoteMeta(field))
+	}
+	values := `"(?:[^"\\\n]|\\.)*"|'[^'\n]*'`
+	if format == "yaml" {
+		values += `|[^\s"'#\[{][^#\n]*`
+	}
+	pattern, err := regexp.Compile(`(?m)((?:^|[\s{,])"?(?:` + strings.Join(names, "|") + `)"?[ \t]*[=:][ \t]*)(` + values + `)`)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	count := 0
+	var replaceErr error
+	result := pattern.ReplaceAllFunc(data, func(match []byte) []byte {
+		if replaceErr != nil {
+			return match
+		}
+		groups := pattern.FindSubmatch(match)
+		prefix, literal := groups[1], strings.TrimRight(string(groups[2]), " \t\r")
+		value, err := unquote(literal)
+		if err != nil {
+			replaceErr = err
+			return match
+		}
+		if (value == "") || IsEncrypted(value) || strings.Contains(value, "${") {
+			return match
+		}
+		encrypted, err := Encrypt(key, value)
+		if err != nil {
+			replaceErr = err
+			return match
+		}
+		count++
+		return []byte(string(prefix) + strconv.Quote(encrypted) + string(groups[2])[len(literal):])
+	})
+	if replaceErr != nil {
+		return nil, 0, replaceErr
+	}
+
+	err = verifyRewrite(data, key, result, key, format)
+	if err != nil {
+		return nil, 0, err
+	}
+	return result, count, nil
+}
+
+// RotateKey re-encrypts the encrypted values in the text of a config file in
+// the specified format with a new key. It returns the new text and the number
+// of values re-encrypted.
+func RotateKey(data []byte, format string, oldKey *Key, newKey *Key) ([]byte, int, error) {
+	count := 0
+	var replaceErr error
+	result := encryptedValuePattern.ReplaceAllFunc(data, func(match []byte) []byte {
+		if replaceErr != nil {
+			return match
+		}
+		value, err := Decrypt(oldKey, string(match))
+		if err != nil {
+			replaceErr = err
+			return match
+		}
+		encrypted, err := Encrypt(newKey, value)
+		if err != nil {
+			replaceErr = err
+			return match
+		}
+		count++
+		return []byte(encrypted)
+	})
+	if replaceErr != nil {
+		return nil, 0, replaceErr
+	}
+
+	err := verifyRewrite(data, oldKey, result, newKey, format)
+	if err != nil {
+		return nil, 0, err
+	}
+	return result, count, nil
+}
+
+// unquote returns the value of a double-quoted, single-quoted or plain
+// string literal.
+func unquote(literal string) (string, error) {
+	switch {
+	case strings.HasPrefix(literal, `"`):
+		value, err := strconv.Unquote(literal)
+		if err != nil {
+			return "", fmt.Errorf("cannot decode string %s: %w", literal, err)
+		}
+		return value, nil
+	case strings.HasPrefix(literal, "'"):
+		return literal[1 : len(literal)-1], nil
+	}
+	return literal, nil
+}
+
+// verifyRewrite checks that the rewritten text parses to the same values as
+// the original text once decrypted, so that a value that was not found or
+// decoded correctly does not corrupt the file.
+func verifyRewrite(oldData []byte, oldKey *Key, newData []byte, newKey *Key, format string) error {
+	parser, err := getParser(format)
+	if err != nil {
+		return err
+	}
+	oldValues, err := parser.Unmarshal(oldData)
+	if err != nil {
+		return err
+	}
+	newValues, err := parser.Unmarshal(newData)
+	if err != nil {
+		return fmt.Errorf("rewritten config cannot be parsed: %w", err)
+	}
+	oldDecrypted, err := decryptValues(oldValues, oldKey)
+	if err != nil {
+		return err
+	}
+	newDecrypted, err := decryptValues(newValues, newKey)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(oldDecrypted, newDecrypted) {
+		return errors.New("rewritten config does not match the original; values may be written in an unsupported style")
+	}
+	return nil
+}
+
+// decryptValues returns a copy of a parsed config with encrypted values
+// decrypted.
+func decryptValues(value any, key *Key) (any, error) {
+	switch v := value.(type) {
+	case string:
+		if !IsEncrypted(v) {
+			return v, nil
+		}
+		return Decrypt(key, v)
+	case map[string]any:
+		m := make(map[string]any, len(v))
+		for k, item := range v {
+			decrypted, err := decryptValues(item, key)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = decrypted
+		}
+		return m, nil
+	case []any:
+		s := make([]any, 0, len(v))
+		for _, item := range v {
+			decrypted, err := decryptValues(item, key)
+			if err != nil {
+				return nil, err
+			}
+			s = append(s, decrypted)
+		}
+		return s, nil
+	case []map[string]any:
+		s := make([]any, 0, len(v))
+		for _, item := range v {
+			decrypted, err := decryptValues(item, key)
+			if err != nil {
+				return nil, err
+			}
+			s = append(s, decrypted)
+		}
+		return s, nil
+	}
+	return value, nil
+}
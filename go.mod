@@ -14,6 +14,7 @@ require (
 	github.com/trzsz/ssh_config v1.3.8
 	github.com/urfave/cli/v3 v3.10.1
 	golang.org/x/crypto v0.54.0
+	golang.org/x/term v0.45.0
 )
 
 require (
@@ -1,23 +1,105 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/knadh/koanf/parsers/yaml"
 	"github.com/ngyewch/pq-provisioner/config"
 	"github.com/ngyewch/pq-provisioner/provisioner"
 	"github.com/urfave/cli/v3"
+	"golang.org/x/term"
+)
+
+const (
+	// exitCodeDrift is returned by the plan command when the server differs from the config.
+	exitCodeDrift = 2
 )
 
 var (
 	version string
 
-	flagConfig = &cli.StringFlag{
+	// provisionerOptions are passed to the provisioners the commands create,
+	// so that tests can connect them to a fake server.
+	provisionerOptions []provisioner.Option
+
+	flagConfig = &cli.StringSliceFlag{
+		Name:     "config",
+		Usage:    "config file, directory of config files, or - for stdin; may be repeated to merge several",
+		Required: true,
+	}
+	flagConfigFormat = &cli.StringFlag{
+		Name:  "config-format",
+		Usage: "format of the config read from stdin (toml, yaml or json)",
+	}
+	flagRotateConfig = &cli.StringFlag{
 		Name:     "config",
-		Usage:    "config file",
+		Usage:    "config file to re-encrypt values in, in place",
 		Required: true,
 	}
+	flagPrune = &cli.BoolFlag{
+		Name:  "prune",
+		Usage: "drop roles and databases that are not declared in the config",
+	}
+	flagOutput = &cli.StringFlag{
+		Name:  "output",
+		Usage: "output file (default: stdout)",
+	}
+	flagFormat = &cli.StringFlag{
+		Name:  "format",
+		Usage: "output format (toml, yaml or json; default: from the output file extension, or toml)",
+	}
+	flagReport = &cli.StringFlag{
+		Name:  "report",
+		Usage: "write a report of the actions taken to the file, or - for stdout",
+	}
+	flagReportFormat = &cli.StringFlag{
+		Name:  "report-format",
+		Usage: "report format (json or yaml; default: from the report file extension, or json)",
+	}
+	flagWait = &cli.DurationFlag{
+		Name:  "wait",
+		Usage: "wait up to this long for the server to accept connections and leave recovery before provisioning",
+	}
+	flagTimeout = &cli.DurationFlag{
+		Name:  "timeout",
+		Usage: "how long to wait for the server, or 0 to wait indefinitely",
+		Value: time.Minute,
+	}
+	flagKeyFile = &cli.StringFlag{
+		Name:  "key-file",
+		Usage: "file containing the encryption key (default: from $PQ_PROVISIONER_KEY or $PQ_PROVISIONER_KEY_FILE)",
+	}
+	flagNewKeyFile = &cli.StringFlag{
+		Name:     "new-key-file",
+		Usage:    "file containing the new encryption key, see generate-key",
+		Required: true,
+	}
+	flagEncryptConfig = &cli.StringFlag{
+		Name:  "config",
+		Usage: "config file to encrypt values in, in place (default: encrypt a value read from stdin)",
+	}
+	flagField = &cli.StringSliceFlag{
+		Name:  "field",
+		Usage: "name of the keys whose values are encrypted",
+		Value: []string{"password"},
+	}
+	flagReconcilePasswords = &cli.BoolFlag{
+		Name:  "reconcile-passwords",
+		Usage: "re-apply configured passwords to existing users whose password differs",
+	}
 
 	app = &cli.Command{
 		Name:    "pq-provisioner",
@@ -31,36 +113,518 @@ var (
 				Action: doProvision,
 				Flags: []cli.Flag{
 					flagConfig,
+					flagConfigFormat,
+					flagReconcilePasswords,
+					flagPrune,
+					flagReport,
+					flagReportFormat,
+					flagWait,
+				},
+				// Config paths may contain commas.
+				DisableSliceFlagSeparator: true,
+			},
+			{
+				Name:   "plan",
+				Usage:  "show the statements that provision would execute, without modifying the server",
+				Action: doPlan,
+				Flags: []cli.Flag{
+					flagConfig,
+					flagConfigFormat,
+					flagReconcilePasswords,
+					flagPrune,
+					flagReport,
+					flagReportFormat,
+				},
+				DisableSliceFlagSeparator: true,
+			},
+			{
+				Name:   "wait",
+				Usage:  "wait until the server accepts connections and is not in recovery",
+				Action: doWait,
+				Flags: []cli.Flag{
+					flagConfig,
+					flagConfigFormat,
+					flagTimeout,
+				},
+				DisableSliceFlagSeparator: true,
+			},
+			{
+				Name:   "hash-password",
+				Usage:  "read a password from stdin and print its SCRAM-SHA-256 verifier, for use as a password in the config",
+				Action: doHashPassword,
+			},
+			{
+				Name:   "generate-key",
+				Usage:  "generate a key for encrypting config values",
+				Action: doGenerateKey,
+				Flags: []cli.Flag{
+					flagOutput,
+				},
+			},
+			{
+				Name:   "encrypt",
+				Usage:  "encrypt values in a config file in place, or a value read from stdin",
+				Action: doEncrypt,
+				Flags: []cli.Flag{
+					flagEncryptConfig,
+					flagKeyFile,
+					flagField,
+				},
+			},
+			{
+				Name:   "rotate-key",
+				Usage:  "re-encrypt the encrypted values in a config file in place with a new key",
+				Action: doRotateKey,
+				Flags: []cli.Flag{
+					flagRotateConfig,
+					flagKeyFile,
+					flagNewKeyFile,
 				},
 			},
+			{
+				Name:   "export",
+				Usage:  "write the roles, databases and privileges on the server as a config file",
+				Action: doExport,
+				Flags: []cli.Flag{
+					flagConfig,
+					flagConfigFormat,
+					flagOutput,
+					flagFormat,
+				},
+				DisableSliceFlagSeparator: true,
+			},
 		},
 	}
 )
 
 func main() {
-	err := app.Run(context.Background(), os.Args)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := app.Run(ctx, os.Args)
+	stop()
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
 func doProvision(ctx context.Context, cmd *cli.Command) error {
-	configFilePath := cmd.String(flagConfig.Name)
+	reportFormat, err := getReportFormat(cmd)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := loadConfig(cmd)
+	if err != nil {
+		return err
+	}
+
+	wait := cmd.Duration(flagWait.Name)
+	if wait > 0 {
+		err = provisioner.Wait(ctx, cfg, nil, wait, provisionerOptions...)
+		if err != nil {
+			return err
+		}
+	}
 
-	cfg, err := config.LoadFromFile(configFilePath)
+	options := []provisioner.Option{
+		provisioner.WithReconcilePasswords(cmd.Bool(flagReconcilePasswords.Name)),
+		provisioner.WithPrune(cmd.Bool(flagPrune.Name)),
+	}
+	configProvisioner, err := provisioner.NewConfigProvisioner(ctx, cfg, nil, append(options, provisionerOptions...)...)
+	if err != nil {
+		return err
+	}
+	defer func(configProvisioner *provisioner.ConfigProvisioner) {
+		_ = configProvisioner.Close()
+	}(configProvisioner)
+
+	report, err := configProvisioner.Provision(ctx)
+	if report != nil {
+		reportErr := writeReport(cmd, reportFormat, report)
+		if err == nil {
+			err = reportErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func doPlan(ctx context.Context, cmd *cli.Command) error {
+	reportFormat, err := getReportFormat(cmd)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := loadConfig(cmd)
+	if err != nil {
+		return err
+	}
+
+	options := []provisioner.Option{
+		provisioner.WithReconcilePasswords(cmd.Bool(flagReconcilePasswords.Name)),
+		provisioner.WithPrune(cmd.Bool(flagPrune.Name)),
+	}
+	configProvisioner, err := provisioner.NewConfigProvisioner(ctx, cfg, nil, append(options, provisionerOptions...)...)
+	if err != nil {
+		return err
+	}
+	defer func(configProvisioner *provisioner.ConfigProvisioner) {
+		_ = configProvisioner.Close()
+	}(configProvisioner)
+
+	plan, err := configProvisioner.Plan(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = writeReport(cmd, reportFormat, &provisioner.Report{
+		DryRun:  true,
+		Actions: plan.Actions,
+		Drifts:  plan.Drifts,
+	})
 	if err != nil {
 		return err
 	}
 
-	configProvisioner, err := provisioner.NewConfigProvisioner(cfg, nil)
+	w := cmd.Root().Writer
+	if cmd.String(flagReport.Name) == "-" {
+		// Keep stdout for the report.
+		w = cmd.Root().ErrWriter
+	}
+	databaseName := ""
+	transaction := 0
+	for i, statement := range plan.Statements {
+		if (transaction != 0) && (statement.Transaction != transaction) {
+			_, _ = fmt.Fprintln(w, "COMMIT;")
+		}
+		if (i == 0) || (statement.Database != databaseName) {
+			databaseName = statement.Database
+			if databaseName == "" {
+				_, _ = fmt.Fprintln(w, "-- admin connection")
+			} else {
+				_, _ = fmt.Fprintf(w, "-- database: %s\n", databaseName)
+			}
+		}
+		if (statement.Transaction != 0) && (statement.Transaction != transaction) {
+			_, _ = fmt.Fprintln(w, "BEGIN;")
+		}
+		transaction = statement.Transaction
+		_, _ = fmt.Fprintf(w, "%s;\n", statement.SQL)
+	}
+	if transaction != 0 {
+		_, _ = fmt.Fprintln(w, "COMMIT;")
+	}
+
+	for _, drift := range plan.Drifts {
+		_, _ = fmt.Fprintf(w, "-- drift: %s: %s\n", drift.Object, drift.Message)
+	}
+
+	if (len(plan.Statements) > 0) || (len(plan.Drifts) > 0) {
+		return cli.Exit("", exitCodeDrift)
+	}
+
+	return nil
+}
+
+func doWait(ctx context.Context, cmd *cli.Command) error {
+	cfg, err := loadConfig(cmd)
 	if err != nil {
 		return err
 	}
 
-	err = configProvisioner.Provision()
+	return provisioner.Wait(ctx, cfg, nil, cmd.Duration(flagTimeout.Name), provisionerOptions...)
+}
+
+func doHashPassword(ctx context.Context, cmd *cli.Command) error {
+	password, err := readPassword(cmd)
 	if err != nil {
 		return err
 	}
+	if password == "" {
+		return fmt.Errorf("no password given")
+	}
 
+	verifier, err := provisioner.SCRAMVerifier(password)
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintln(cmd.Root().Writer, verifier)
 	return nil
 }
+
+// readPassword reads the password without echo when stdin is a terminal,
+// otherwise it reads a single line so it can be piped in.
+func readPassword(cmd *cli.Command) (string, error) {
+	reader := cmd.Root().Reader
+	if f, ok := reader.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		_, _ = fmt.Fprint(cmd.Root().ErrWriter, "Password: ")
+		data, err := term.ReadPassword(int(f.Fd()))
+		_, _ = fmt.Fprintln(cmd.Root().ErrWriter)
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	}
+
+	line, err := bufio.NewReader(reader).ReadString('\n')
+	if (err != nil) && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func doGenerateKey(ctx context.Context, cmd *cli.Command) error {
+	outputPath := cmd.String(flagOutput.Name)
+
+	key, err := config.GenerateKey()
+	if err != nil {
+		return err
+	}
+
+	if outputPath == "" {
+		_, err = fmt.Fprintln(cmd.Root().Writer, key.String())
+		return err
+	}
+	f, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(f, key.String())
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func doEncrypt(ctx context.Context, cmd *cli.Command) error {
+	configFilePath := cmd.String(flagEncryptConfig.Name)
+
+	key, err := loadKey(cmd.String(flagKeyFile.Name))
+	if err != nil {
+		return err
+	}
+
+	if configFilePath == "" {
+		line, err := bufio.NewReader(cmd.Root().Reader).ReadString('\n')
+		if (err != nil) && !errors.Is(err, io.EOF) {
+			return err
+		}
+		value := strings.TrimRight(line, "\r\n")
+		if value == "" {
+			return fmt.Errorf("no value given")
+		}
+		encrypted, err := config.Encrypt(key, value)
+		if err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintln(cmd.Root().Writer, encrypted)
+		return nil
+	}
+
+	format, err := config.FormatFromPath(configFilePath)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(configFilePath)
+	if err != nil {
+		return err
+	}
+	data, count, err := config.EncryptValues(data, format, key, cmd.StringSlice(flagField.Name))
+	if err != nil {
+		return fmt.Errorf("%s: %w", configFilePath, err)
+	}
+	if count == 0 {
+		return nil
+	}
+	err = rewriteFile(configFilePath, data)
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(cmd.Root().ErrWriter, "Encrypted %d values in %s\n", count, configFilePath)
+	return nil
+}
+
+func doRotateKey(ctx context.Context, cmd *cli.Command) error {
+	configFilePath := cmd.String(flagRotateConfig.Name)
+
+	oldKey, err := loadKey(cmd.String(flagKeyFile.Name))
+	if err != nil {
+		return err
+	}
+	newKey, err := config.ReadKeyFile(cmd.String(flagNewKeyFile.Name))
+	if err != nil {
+		return err
+	}
+
+	format, err := config.FormatFromPath(configFilePath)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(configFilePath)
+	if err != nil {
+		return err
+	}
+	data, count, err := config.RotateKey(data, format, oldKey, newKey)
+	if err != nil {
+		return fmt.Errorf("%s: %w", configFilePath, err)
+	}
+	if count == 0 {
+		return nil
+	}
+	err = rewriteFile(configFilePath, data)
+	if err != nil {
+		return err
+	}
+	_, _ = fmt.Fprintf(cmd.Root().ErrWriter, "Re-encrypted %d values in %s\n", count, configFilePath)
+	return nil
+}
+
+// loadConfig loads and merges the config files given with --config.
+func loadConfig(cmd *cli.Command) (*config.Main, error) {
+	return config.LoadFromPaths(cmd.StringSlice(flagConfig.Name), cmd.Root().Reader, cmd.String(flagConfigFormat.Name))
+}
+
+// loadKey reads the encryption key from the key file, if specified, or from
+// the environment.
+func loadKey(keyFilePath string) (*config.Key, error) {
+	if keyFilePath != "" {
+		return config.ReadKeyFile(keyFilePath)
+	}
+	return config.LoadKey()
+}
+
+// rewriteFile replaces the contents of a file, keeping its permissions, by
+// renaming a temporary file over it so that it is never left half-written.
+func rewriteFile(path string, data []byte) error {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func(name string) {
+		_ = os.Remove(name)
+	}(f.Name())
+	_, err = f.Write(data)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	err = f.Chmod(stat.Mode().Perm())
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+func doExport(ctx context.Context, cmd *cli.Command) error {
+	outputPath := cmd.String(flagOutput.Name)
+
+	format := cmd.String(flagFormat.Name)
+	if format == "" {
+		format = "toml"
+		if outputPath != "" {
+			var err error
+			format, err = config.FormatFromPath(outputPath)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if !slices.Contains(config.Formats, format) {
+		return fmt.Errorf("unsupported format %s", format)
+	}
+
+	cfg, err := loadConfig(cmd)
+	if err != nil {
+		return err
+	}
+
+	configProvisioner, err := provisioner.NewConfigProvisioner(ctx, cfg, nil, provisionerOptions...)
+	if err != nil {
+		return err
+	}
+	defer func(configProvisioner *provisioner.ConfigProvisioner) {
+		_ = configProvisioner.Close()
+	}(configProvisioner)
+
+	exported, err := configProvisioner.Export(ctx)
+	if err != nil {
+		return err
+	}
+
+	data, err := config.Marshal(exported, format)
+	if err != nil {
+		return err
+	}
+
+	if outputPath == "" {
+		_, err = cmd.Root().Writer.Write(data)
+		return err
+	}
+	return os.WriteFile(outputPath, data, 0600)
+}
+
+// getReportFormat returns the format of the report, which defaults to the
+// extension of the report file, or json.
+func getReportFormat(cmd *cli.Command) (string, error) {
+	format := cmd.String(flagReportFormat.Name)
+	if format == "" {
+		format = "json"
+		reportPath := cmd.String(flagReport.Name)
+		if (reportPath != "") && (reportPath != "-") {
+			var err error
+			format, err = config.FormatFromPath(reportPath)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	if (format != "json") && (format != "yaml") {
+		return "", fmt.Errorf("unsupported report format %s", format)
+	}
+	return format, nil
+}
+
+// writeReport writes the report to the file specified by the report flag, if
+// any.
+func writeReport(cmd *cli.Command, format string, report *provisioner.Report) error {
+	reportPath := cmd.String(flagReport.Name)
+	if reportPath == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if format == "yaml" {
+		var m map[string]any
+		err = json.Unmarshal(data, &m)
+		if err != nil {
+			return err
+		}
+		data, err = yaml.Parser().Marshal(m)
+		if err != nil {
+			return err
+		}
+	} else {
+		data = append(data, '\n')
+	}
+
+	if reportPath == "-" {
+		_, err = cmd.Root().Writer.Write(data)
+		return err
+	}
+	return os.WriteFile(reportPath, data, 0600)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"testing"
+
+	"github.com/ngyewch/pq-provisioner/provisioner"
+	"github.com/ngyewch/pq-provisioner/provisioner/fake"
+	"github.com/urfave/cli/v3"
+)
+
+// runCommand runs the command line against the fake server and returns the
+// exit code it would exit with.
+func runCommand(t *testing.T, server *fake.Server, args ...string) int {
+	provisionerOptions = []provisioner.Option{provisioner.WithConnector(server.Connect)}
+	app.Writer = io.Discard
+	app.ErrWriter = io.Discard
+	app.ExitErrHandler = func(ctx context.Context, cmd *cli.Command, err error) {}
+	t.Cleanup(func() {
+		provisionerOptions = nil
+		app.Writer = nil
+		app.ErrWriter = nil
+		app.ExitErrHandler = nil
+	})
+
+	err := app.Run(t.Context(), append([]string{"pq-provisioner"}, args...))
+	if err == nil {
+		return 0
+	}
+	var exitCoder cli.ExitCoder
+	if errors.As(err, &exitCoder) {
+		return exitCoder.ExitCode()
+	}
+	t.Fatal(err)
+	return 0
+}
+
+func TestPlanExitCode(t *testing.T) {
+	configPath := filepath.Join("test", "resources", "config", "test1.toml")
+	server := fake.NewServer(160004)
+
+	exitCode := runCommand(t, server, "plan", "--config", configPath)
+	if exitCode != exitCodeDrift {
+		t.Errorf("expected exit code %d before provisioning, got %d", exitCodeDrift, exitCode)
+	}
+
+	exitCode = runCommand(t, server, "provision", "--config", configPath)
+	if exitCode != 0 {
+		t.Fatalf("expected provision to succeed, got exit code %d", exitCode)
+	}
+
+	exitCode = runCommand(t, server, "plan", "--config", configPath)
+	if exitCode != 0 {
+		t.Errorf("expected exit code 0 after provisioning, got %d", exitCode)
+	}
+}
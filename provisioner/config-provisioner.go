@@ -5,6 +5,9 @@ import (
 	"database/sql"
 	"fmt"
 	"log/slog"
+	"math"
+	"path"
+	"slices"
 
 	"github.com/ngyewch/go-pqssh"
 	ssh_helper "github.com/ngyewch/go-ssh-helper"
@@ -17,22 +20,67 @@ var (
 )
 
 type ConfigProvisioner struct {
-	cfg       *config.Main
-	sshClient *ssh.Client
+	cfg                *config.Main
+	sshClient          *ssh.Client
+	reconcilePasswords bool
+	prune              bool
+	connector          Connector
+	// passwords caches the resolved passwords by user name, so that each
+	// source is only read once.
+	passwords map[string]string
 }
 
-func NewConfigProvisioner(cfg *config.Main, sshClientFactory *ssh_helper.SSHClientFactory) (*ConfigProvisioner, error) {
+// Option configures a ConfigProvisioner.
+type Option func(p *ConfigProvisioner)
+
+// WithReconcilePasswords re-applies the configured password to existing users
+// whose stored password verifier does not match. If the verifier cannot be
+// read, the password is always re-applied.
+func WithReconcilePasswords(reconcilePasswords bool) Option {
+	return func(p *ConfigProvisioner) {
+		p.reconcilePasswords = reconcilePasswords
+	}
+}
+
+// Connector opens a connection to the named database as the user.
+type Connector func(ctx context.Context, databaseName string, user string) (Conn, error)
+
+// WithConnector replaces the PostgreSQL connections opened from the config,
+// for example with connections to an in-memory fake.
+func WithConnector(connector Connector) Option {
+	return func(p *ConfigProvisioner) {
+		p.connector = connector
+	}
+}
+
+// WithPrune drops roles and databases on the server that are not declared in
+// the config, except system roles, the admin user, template databases, the
+// admin database and those in the ignore lists.
+func WithPrune(prune bool) Option {
+	return func(p *ConfigProvisioner) {
+		p.prune = prune
+	}
+}
+
+// NewConfigProvisioner returns a ConfigProvisioner for the config. If the
+// config specifies an ssh proxy, it is connected to before returning, within
+// the connect timeout.
+func NewConfigProvisioner(ctx context.Context, cfg *config.Main, sshClientFactory *ssh_helper.SSHClientFactory, options ...Option) (*ConfigProvisioner, error) {
 	p := &ConfigProvisioner{
-		cfg: cfg,
+		cfg:       cfg,
+		passwords: make(map[string]string),
 	}
-	if cfg.SshProxy != "" {
-		log.LogAttrs(context.Background(), slog.LevelInfo, "Creating ssh proxy",
+	for _, option := range options {
+		option(p)
+	}
+	if (cfg.SshProxy != "") && (p.connector == nil) {
+		log.LogAttrs(ctx, slog.LevelInfo, "Creating ssh proxy",
 			slog.String("proxy", cfg.SshProxy),
 		)
 		if sshClientFactory == nil {
 			sshClientFactory = ssh_helper.DefaultSSHClientFactory()
 		}
-		sshClient, err := sshClientFactory.CreateForAlias(cfg.SshProxy)
+		sshClient, err := p.createSSHClient(ctx, sshClientFactory)
 		if err != nil {
 			return nil, err
 		}
@@ -41,6 +89,62 @@ func NewConfigProvisioner(cfg *config.Main, sshClientFactory *ssh_helper.SSHClie
 	return p, nil
 }
 
+// createSSHClient connects to the ssh proxy. The ssh client factory does not
+// take a context, so the connection is made in the background and abandoned
+// (and closed once established) if the context is done or the connect timeout
+// elapses first.
+func (p *ConfigProvisioner) createSSHClient(ctx context.Context, sshClientFactory *ssh_helper.SSHClientFactory) (*ssh.Client, error) {
+	ctx, cancel := p.connectContext(ctx)
+	defer cancel()
+
+	type result struct {
+		client *ssh.Client
+		err    error
+	}
+	done := make(chan result, 1)
+	go func() {
+		client, err := sshClientFactory.CreateForAlias(p.cfg.SshProxy)
+		done <- result{client: client, err: err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.client, r.err
+	case <-ctx.Done():
+		go func() {
+			r := <-done
+			if r.client != nil {
+				_ = r.client.Close()
+			}
+		}()
+		return nil, fmt.Errorf("connecting to ssh proxy %s: %w", p.cfg.SshProxy, context.Cause(ctx))
+	}
+}
+
+// closeSSHClientWhenDone closes the ssh proxy when the context is done, which
+// unblocks database connections waiting on a hung tunnel. The returned
+// function stops watching the context.
+func (p *ConfigProvisioner) closeSSHClientWhenDone(ctx context.Context) func() bool {
+	if p.sshClient == nil {
+		return func() bool {
+			return false
+		}
+	}
+	return context.AfterFunc(ctx, func() {
+		_ = p.sshClient.Close()
+	})
+}
+
+// connectContext returns a context that is done when the connect timeout, if
+// any, elapses.
+func (p *ConfigProvisioner) connectContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.cfg.ConnectTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, p.cfg.ConnectTimeout,
+		fmt.Errorf("connect timeout of %s exceeded", p.cfg.ConnectTimeout))
+}
+
 func (p *ConfigProvisioner) Close() error {
 	if p.sshClient != nil {
 		err := p.sshClient.Close()
@@ -51,87 +155,445 @@ func (p *ConfigProvisioner) Close() error {
 	return nil
 }
 
-func (p *ConfigProvisioner) Provision() error {
-	db, err := p.openDB(p.cfg.Database, p.cfg.User)
+// Plan is the result of comparing the config against the server.
+type Plan struct {
+	Statements []Statement
+	Actions    []Action
+	Drifts     []Drift
+}
+
+// Provision brings the server in line with the config, and returns a report
+// of the actions taken. If provisioning fails, the report holds the actions
+// taken up to and including the one that failed, and is nil if the server
+// could not be read. If another run holds the advisory lock for longer than
+// the lock timeout, the error wraps ErrLocked.
+func (p *ConfigProvisioner) Provision(ctx context.Context) (*Report, error) {
+	prov, err := p.run(ctx, false)
+	if prov == nil {
+		return nil, err
+	}
+	return &Report{
+		Actions: prov.Actions(),
+		Drifts:  prov.Drifts(),
+	}, err
+}
+
+// Plan compares the config against the server without modifying it, and
+// returns the statements that Provision would execute.
+func (p *ConfigProvisioner) Plan(ctx context.Context) (*Plan, error) {
+	prov, err := p.run(ctx, true)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer func(db *sql.DB) {
-		_ = db.Close()
-	}(db)
+	return &Plan{
+		Statements: prov.Statements(),
+		Actions:    prov.Actions(),
+		Drifts:     prov.Drifts(),
+	}, nil
+}
+
+// run provisions the config, and returns the Provisioner that recorded the
+// actions, which is nil if the server could not be read. Unless in dry-run
+// mode, the advisory lock is held on the admin connection for the whole run.
+//
+// Statements are executed in one transaction for the groups, and then for
+// each database, one transaction on the admin connection for its roles, owner
+// and settings, and one in the database for its schemas, extensions and
+// privileges. CREATE DATABASE and DROP DATABASE cannot run in a transaction,
+// and are executed on their own between these transactions. If a statement
+// fails, its transaction is rolled back; earlier transactions stay committed.
+func (p *ConfigProvisioner) run(ctx context.Context, dryRun bool) (*Provisioner, error) {
+	stop := p.closeSSHClientWhenDone(ctx)
+	defer stop()
 
-	prov, err := NewProvisioner(db)
+	conn, err := p.openDB(ctx, p.cfg.Database, p.cfg.User)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	defer func(conn Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	if !dryRun {
+		unlock, err := p.takeLock(ctx, conn)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
+
+	var prov *Provisioner
+	if dryRun {
+		prov, err = NewDryRunProvisioner(ctx, conn)
+	} else {
+		prov, err = NewProvisioner(ctx, conn)
+	}
+	if err != nil {
+		return nil, err
+	}
+	prov.SetAllowMD5Passwords(p.cfg.AllowMD5Passwords)
+	defer p.rollback(ctx, prov)
+
+	existingDatabases := prov.DatabaseNames()
+
+	// Fail before changing anything rather than after the other changes
+	// have been committed.
+	for _, database := range p.cfg.Databases {
+		if database.IsAbsent() && database.Protected && prov.HasDatabase(database.Name) {
+			return prov, fmt.Errorf("database %s is protected and cannot be dropped", database.Name)
+		}
+	}
+
+	for _, user := range p.cfg.Users {
+		if user.IsAbsent() {
+			continue
+		}
+		err = p.createUserIfNotExist(ctx, prov, user.Name)
+		if err != nil {
+			return prov, err
+		}
+	}
+
+	for _, group := range p.cfg.Groups {
+		err = p.provisionGroup(ctx, prov, group)
+		if err != nil {
+			return prov, err
+		}
+	}
+	err = prov.Commit()
+	if err != nil {
+		return prov, err
 	}
 
 	for _, database := range p.cfg.Databases {
-		err = p.createDatabaseIfNotExist(prov, database.Name)
+		if database.IsAbsent() {
+			continue
+		}
+
+		databaseExists := prov.HasDatabase(database.Name)
+
+		err = p.createDatabaseIfNotExist(ctx, prov, database)
+		if err != nil {
+			return prov, err
+		}
+
+		err = p.createUserIfNotExist(ctx, prov, database.Owner)
+		if err != nil {
+			return prov, err
+		}
+
+		for _, user := range database.Users {
+			err = p.createUserIfNotExist(ctx, prov, user.Name)
+			if err != nil {
+				return prov, err
+			}
+		}
+
+		for _, schema := range database.Schemas {
+			if schema.Owner != "" {
+				err = p.createUserIfNotExist(ctx, prov, schema.Owner)
+				if err != nil {
+					return prov, err
+				}
+			}
+			for _, user := range schema.Users {
+				err = p.createUserIfNotExist(ctx, prov, user.Name)
+				if err != nil {
+					return prov, err
+				}
+			}
+			for _, creator := range schema.DefaultPrivilegesFor {
+				err = p.createUserIfNotExist(ctx, prov, creator)
+				if err != nil {
+					return prov, err
+				}
+			}
+		}
+
+		if prov.GetDatabaseOwner(database.Name) != database.Owner {
+			log.LogAttrs(ctx, slog.LevelInfo, "Setting database owner",
+				slog.String("dbname", database.Name),
+				slog.String("user", database.Owner),
+			)
+			err = prov.SetDatabaseOwner(ctx, database.Name, database.Owner)
+			if err != nil {
+				return prov, err
+			}
+		}
+
+		if database.Settings != nil {
+			err = prov.SetSettings(ctx, database.Name, "", database.Settings)
+			if err != nil {
+				return prov, err
+			}
+		}
+
+		for _, user := range database.Users {
+			if user.Settings != nil {
+				err = prov.SetSettings(ctx, database.Name, user.Name, user.Settings)
+				if err != nil {
+					return prov, err
+				}
+			}
+		}
+
+		err = p.provisionDatabase(ctx, prov, database, databaseExists)
+		if err != nil {
+			return prov, err
+		}
+	}
+
+	if p.reconcilePasswords {
+		for _, user := range p.cfg.Users {
+			if user.HasPassword() && !user.IsAbsent() && prov.HasUser(user.Name) && !prov.created("", ObjectTypeRole, user.Name) {
+				err = p.reconcilePassword(ctx, prov, user)
+				if err != nil {
+					return prov, err
+				}
+			}
+		}
+	}
+
+	for _, user := range p.cfg.Users {
+		if (user.Settings != nil) && !user.IsAbsent() && prov.HasUser(user.Name) {
+			err = prov.SetSettings(ctx, "", user.Name, user.Settings)
+			if err != nil {
+				return prov, err
+			}
+		}
+	}
+
+	err = p.dropAbsent(ctx, prov, existingDatabases)
+	if err != nil {
+		return prov, err
+	}
+
+	if p.prune {
+		err = p.pruneUndeclared(ctx, prov, existingDatabases)
+		if err != nil {
+			return prov, err
+		}
+	}
+
+	err = prov.Commit()
+	if err != nil {
+		return prov, err
+	}
+
+	for _, drift := range prov.Drifts() {
+		log.LogAttrs(ctx, slog.LevelWarn, "Drift detected",
+			slog.String("object", drift.Object),
+			slog.String("message", drift.Message),
+		)
+	}
+
+	return prov, nil
+}
+
+// provisionDatabase provisions the schemas and privileges inside a database,
+// connecting to it as the admin user. In dry-run mode, a database that does not
+// exist yet is not connected to.
+func (p *ConfigProvisioner) provisionDatabase(ctx context.Context, prov *Provisioner, database *config.Database, databaseExists bool) error {
+	var conn Conn
+	if !prov.DryRun() || databaseExists {
+		var err error
+		conn, err = p.openDB(ctx, database.Name, p.cfg.User)
 		if err != nil {
 			return err
 		}
+		defer func(conn Conn) {
+			_ = conn.Close()
+		}(conn)
+	}
+	defer p.rollback(ctx, prov)
+
+	dbProv := prov.ForDatabase(database.Name, database.Owner, conn)
+
+	schemas := database.Schemas
+	if !slices.ContainsFunc(schemas, func(schema *config.Schema) bool {
+		return schema.Name == "public"
+	}) {
+		schemas = append([]*config.Schema{{Name: "public"}}, schemas...)
+	}
 
-		err = p.createUserIfNotExist(prov, database.Owner)
+	if !prov.DryRun() {
+		err := p.checkPrivilegesOf(ctx, prov, database, schemas)
 		if err != nil {
 			return err
 		}
+	}
 
-		for _, user := range database.Users {
-			err = p.createUserIfNotExist(prov, user)
+	for _, schema := range schemas {
+		if (schema.Name != "public") || (schema.Owner != "") {
+			err := p.createSchemaIfNotExist(ctx, dbProv, database, schema)
 			if err != nil {
 				return err
 			}
 		}
+	}
 
-		log.LogAttrs(context.Background(), slog.LevelInfo, "Setting database owner",
+	for _, extension := range database.Extensions {
+		log.LogAttrs(ctx, slog.LevelInfo, "Setting extension",
 			slog.String("dbname", database.Name),
-			slog.String("user", database.Owner),
+			slog.String("extension", extension.Name),
 		)
-		err = prov.SetDatabaseOwner(database.Name, database.Owner)
+		err := dbProv.SetExtension(ctx, extension.Name, extension.Schema, extension.Version)
 		if err != nil {
 			return err
 		}
+	}
+
+	for _, schema := range schemas {
+		creators := schema.DefaultPrivilegesFor
+		if (len(creators) == 0) && (schema.Owner != "") {
+			creators = []string{schema.Owner}
+		}
+
+		users := slices.Clone(database.Users)
+		for _, schemaUser := range schema.Users {
+			users = slices.DeleteFunc(users, func(user *config.DatabaseUser) bool {
+				return user.Name == schemaUser.Name
+			})
+			users = append(users, schemaUser)
+		}
 
-		err = func() error {
-			db2, err := p.openDB(database.Name, database.Owner)
+		for _, user := range users {
+			privileges, err := p.getPrivileges(user.Profile)
 			if err != nil {
 				return err
 			}
-			defer func(db *sql.DB) {
-				_ = db.Close()
-			}(db2)
-
-			for _, user := range database.Users {
-				log.LogAttrs(context.Background(), slog.LevelInfo, "Setting database user",
-					slog.String("dbname", database.Name),
-					slog.String("user", user),
-				)
-				err = SetDatabaseUser(db2, user)
-				if err != nil {
-					return err
-				}
+			log.LogAttrs(ctx, slog.LevelInfo, "Setting database user",
+				slog.String("dbname", database.Name),
+				slog.String("schema", schema.Name),
+				slog.String("user", user.Name),
+			)
+			err = dbProv.GrantPrivileges(ctx, schema.Name, user.Name, privileges, creators)
+			if err != nil {
+				return err
 			}
+		}
 
-			return nil
-		}()
+		err := p.revokeUnlisted(ctx, prov, dbProv, database, schema, users, creators)
+		if err != nil {
+			return err
+		}
+	}
+
+	return prov.Commit()
+}
+
+// checkPrivilegesOf checks that the admin user, which manages the schemas and
+// privileges in the database, holds the privileges of the database owner and of
+// the owners of the schemas and of their objects.
+func (p *ConfigProvisioner) checkPrivilegesOf(ctx context.Context, prov *Provisioner, database *config.Database, schemas []*config.Schema) error {
+	roleNames := []string{database.Owner}
+	for _, schema := range schemas {
+		if schema.Owner != "" {
+			roleNames = append(roleNames, schema.Owner)
+		}
+		roleNames = append(roleNames, schema.DefaultPrivilegesFor...)
+	}
+	slices.Sort(roleNames)
+	for _, roleName := range slices.Compact(roleNames) {
+		hasPrivileges, err := prov.HasPrivilegesOf(ctx, roleName)
 		if err != nil {
 			return err
 		}
+		if !hasPrivileges {
+			return fmt.Errorf("admin user %s must be a superuser or inherit from %s to manage privileges in database %s",
+				p.cfg.User, roleName, database.Name)
+		}
 	}
+	return nil
+}
 
+// revokeUnlisted revokes the privileges in the schema of roles that are no
+// longer listed as its users. The admin user, owners and system roles are left
+// alone.
+func (p *ConfigProvisioner) revokeUnlisted(ctx context.Context, prov *Provisioner, dbProv *DatabaseProvisioner, database *config.Database,
+	schema *config.Schema, users []*config.DatabaseUser, creators []string) error {
+	grantees, err := dbProv.GetGrantees(ctx, schema.Name)
+	if err != nil {
+		return err
+	}
+	for _, grantee := range grantees {
+		if slices.ContainsFunc(users, func(user *config.DatabaseUser) bool {
+			return user.Name == grantee
+		}) {
+			continue
+		}
+		if (grantee == p.cfg.User) || (grantee == database.Owner) || (grantee == schema.Owner) ||
+			slices.Contains(creators, grantee) || prov.IsSystemRole(grantee) {
+			continue
+		}
+		log.LogAttrs(ctx, slog.LevelInfo, "Revoking database user",
+			slog.String("dbname", database.Name),
+			slog.String("schema", schema.Name),
+			slog.String("user", grantee),
+		)
+		err = dbProv.RevokePrivileges(ctx, schema.Name, grantee)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
-func (p *ConfigProvisioner) createDatabaseIfNotExist(prov *Provisioner, dbname string) error {
-	if prov.HasDatabase(dbname) {
+func (p *ConfigProvisioner) createSchemaIfNotExist(ctx context.Context, dbProv *DatabaseProvisioner, database *config.Database, schema *config.Schema) error {
+	owner := schema.Owner
+	if owner == "" {
+		owner = database.Owner
+	}
+
+	currentOwner, err := dbProv.GetSchemaOwner(ctx, schema.Name)
+	if err != nil {
+		return err
+	}
+	if currentOwner == owner {
+		dbProv.skip(schema.Name)
 		return nil
 	}
 
-	log.LogAttrs(context.Background(), slog.LevelInfo, "Creating database",
-		slog.String("dbname", dbname),
+	if currentOwner == "" {
+		log.LogAttrs(ctx, slog.LevelInfo, "Creating schema",
+			slog.String("dbname", database.Name),
+			slog.String("schema", schema.Name),
+			slog.String("user", owner),
+		)
+		return dbProv.CreateSchema(ctx, schema.Name, owner)
+	}
+
+	log.LogAttrs(ctx, slog.LevelInfo, "Setting schema owner",
+		slog.String("dbname", database.Name),
+		slog.String("schema", schema.Name),
+		slog.String("user", owner),
+	)
+	return dbProv.SetSchemaOwner(ctx, schema.Name, owner)
+}
+
+func (p *ConfigProvisioner) createDatabaseIfNotExist(ctx context.Context, prov *Provisioner, database *config.Database) error {
+	options := &DatabaseOptions{
+		Template:         database.Template,
+		Encoding:         database.Encoding,
+		LcCollate:        database.LcCollate,
+		LcCtype:          database.LcCtype,
+		LocaleProvider:   database.LocaleProvider,
+		IcuLocale:        database.IcuLocale,
+		Tablespace:       database.Tablespace,
+		ConnectionLimit:  database.ConnectionLimit,
+		IsTemplate:       database.IsTemplate,
+		AllowConnections: database.AllowConnections,
+	}
+
+	if prov.HasDatabase(database.Name) {
+		return prov.SetDatabaseOptions(ctx, database.Name, options)
+	}
+
+	log.LogAttrs(ctx, slog.LevelInfo, "Creating database",
+		slog.String("dbname", database.Name),
 	)
 
-	err := prov.CreateDatabase(dbname)
+	err := prov.CreateDatabase(ctx, database.Name, options)
 	if err != nil {
 		return err
 	}
@@ -139,23 +601,105 @@ func (p *ConfigProvisioner) createDatabaseIfNotExist(prov *Provisioner, dbname s
 	return nil
 }
 
-func (p *ConfigProvisioner) createUserIfNotExist(prov *Provisioner, username string) error {
-	if prov.HasUser(username) {
+func (p *ConfigProvisioner) provisionGroup(ctx context.Context, prov *Provisioner, group *config.Group) error {
+	err := p.createGroupIfNotExist(ctx, prov, group.Name)
+	if err != nil {
+		return err
+	}
+
+	memberships := make([]*Membership, 0)
+	for _, member := range group.Members {
+		if p.cfg.GetGroup(member.Name) != nil {
+			err = p.createGroupIfNotExist(ctx, prov, member.Name)
+		} else {
+			err = p.createUserIfNotExist(ctx, prov, member.Name)
+		}
+		if err != nil {
+			return err
+		}
+		memberships = append(memberships, &Membership{
+			Member:  member.Name,
+			Admin:   member.Admin,
+			Inherit: member.Inherit,
+			Set:     member.Set,
+		})
+	}
+
+	log.LogAttrs(ctx, slog.LevelInfo, "Setting group members",
+		slog.String("group", group.Name),
+	)
+	err = prov.SetMemberships(ctx, group.Name, memberships, []string{p.cfg.User})
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (p *ConfigProvisioner) createGroupIfNotExist(ctx context.Context, prov *Provisioner, groupName string) error {
+	if prov.HasUser(groupName) {
+		prov.skip("", ObjectTypeRole, groupName)
 		return nil
 	}
 
-	log.LogAttrs(context.Background(), slog.LevelInfo, "Creating user",
-		slog.String("user", username),
+	log.LogAttrs(ctx, slog.LevelInfo, "Creating group",
+		slog.String("group", groupName),
 	)
 
+	err := prov.CreateGroup(ctx, groupName)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (p *ConfigProvisioner) createUserIfNotExist(ctx context.Context, prov *Provisioner, username string) error {
+	if p.cfg.GetGroup(username) != nil {
+		return p.createGroupIfNotExist(ctx, prov, username)
+	}
+
 	user := p.cfg.GetUser(username)
 	if user == nil {
+		if prov.HasUser(username) {
+			return nil
+		}
 		return fmt.Errorf("user not defined")
 	}
-	if user.Password == "" {
+	if user.IsAbsent() {
+		return fmt.Errorf("user %s is declared absent", user.Name)
+	}
+	if prov.handled("", ObjectTypeRole, user.Name) {
+		return nil
+	}
+	attributes := &RoleAttributes{
+		Login:           user.Login,
+		Superuser:       user.Superuser,
+		CreateDB:        user.CreateDB,
+		CreateRole:      user.CreateRole,
+		Inherit:         user.Inherit,
+		Replication:     user.Replication,
+		BypassRLS:       user.BypassRLS,
+		ConnectionLimit: user.ConnectionLimit,
+		ValidUntil:      user.ValidUntil,
+	}
+
+	if prov.HasUser(username) {
+		return prov.SetUserAttributes(ctx, user.Name, attributes)
+	}
+
+	log.LogAttrs(ctx, slog.LevelInfo, "Creating user",
+		slog.String("user", username),
+	)
+
+	password, err := p.password(ctx, user)
+	if err != nil {
+		return err
+	}
+	if (password == "") && ((user.Login == nil) || *user.Login) {
 		return fmt.Errorf("user password not specified")
 	}
-	err := prov.CreateUser(user.Name, user.Password)
+	err = prov.CreateUser(ctx, user.Name, password, attributes)
 	if err != nil {
 		return err
 	}
@@ -163,25 +707,274 @@ func (p *ConfigProvisioner) createUserIfNotExist(prov *Provisioner, username str
 	return nil
 }
 
-func (p *ConfigProvisioner) openDB(dbname string, user string) (*sql.DB, error) {
-	dsn := p.buildConnectionString(dbname, user, p.cfg.Host, p.cfg.Port, p.cfg.SslMode)
-	if p.sshClient != nil {
-		dbConnector := pqssh.NewConnector(p.sshClient, dsn)
-		return sql.OpenDB(dbConnector), nil
+func (p *ConfigProvisioner) getPrivileges(profileName string) (*Privileges, error) {
+	if profileName == "" {
+		profileName = DefaultProfile
+	}
+	profile := p.cfg.GetProfile(profileName)
+	if profile != nil {
+		return &Privileges{
+			Schema:    profile.Schema,
+			Tables:    profile.Tables,
+			Sequences: profile.Sequences,
+		}, nil
+	}
+	privileges, ok := BuiltinProfiles[profileName]
+	if !ok {
+		return nil, fmt.Errorf("profile %s not defined", profileName)
+	}
+	return privileges, nil
+}
+
+// maintenanceDatabase is the database that clients and tools connect to by
+// default. It is never pruned.
+const maintenanceDatabase = "postgres"
+
+// pruneUndeclared drops the databases and roles that are not declared in the
+// config. Template databases, the admin, maintenance and lock databases, system
+// roles, the admin user and anything matching the ignore lists are left alone.
+func (p *ConfigProvisioner) pruneUndeclared(ctx context.Context, prov *Provisioner, existingDatabases []string) error {
+	for _, databaseName := range existingDatabases {
+		if (p.cfg.GetDatabase(databaseName) != nil) ||
+			prov.IsTemplateDatabase(databaseName) ||
+			(databaseName == prov.CurrentDatabase()) ||
+			(databaseName == maintenanceDatabase) ||
+			(databaseName == p.cfg.Lock.Database) ||
+			matchesAny(p.cfg.Prune.IgnoreDatabases, databaseName) {
+			continue
+		}
+		log.LogAttrs(ctx, slog.LevelInfo, "Dropping database",
+			slog.String("dbname", databaseName),
+		)
+		err := prov.DropDatabase(ctx, databaseName, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	roleNames := make([]string, 0)
+	for _, roleName := range prov.RoleNames() {
+		if p.cfg.DeclaresRole(roleName) ||
+			prov.IsSystemRole(roleName) ||
+			(roleName == p.cfg.User) ||
+			matchesAny(p.cfg.Prune.IgnoreRoles, roleName) {
+			continue
+		}
+		roleNames = append(roleNames, roleName)
+	}
+	if len(roleNames) == 0 {
+		return nil
+	}
+
+	return p.dropRoles(ctx, prov, existingDatabases, roleNames)
+}
+
+// dropAbsent drops the databases and users that are declared absent.
+func (p *ConfigProvisioner) dropAbsent(ctx context.Context, prov *Provisioner, existingDatabases []string) error {
+	for _, database := range p.cfg.Databases {
+		if !database.IsAbsent() || !prov.HasDatabase(database.Name) {
+			continue
+		}
+		log.LogAttrs(ctx, slog.LevelInfo, "Dropping database",
+			slog.String("dbname", database.Name),
+		)
+		err := prov.DropDatabase(ctx, database.Name, true)
+		if err != nil {
+			return err
+		}
+	}
+
+	roleNames := make([]string, 0)
+	for _, user := range p.cfg.Users {
+		if user.IsAbsent() && prov.HasUser(user.Name) {
+			roleNames = append(roleNames, user.Name)
+		}
+	}
+	if len(roleNames) == 0 {
+		return nil
+	}
+
+	return p.dropRoles(ctx, prov, existingDatabases, roleNames)
+}
+
+// dropRoles drops the roles, after reassigning the objects they own to the
+// admin user and dropping their remaining privileges in every existing
+// database.
+func (p *ConfigProvisioner) dropRoles(ctx context.Context, prov *Provisioner, existingDatabases []string, roleNames []string) error {
+	for _, databaseName := range prov.DatabaseNames() {
+		if !slices.Contains(existingDatabases, databaseName) || !prov.AllowsConnections(databaseName) {
+			continue
+		}
+		err := p.dropOwned(ctx, prov, databaseName, roleNames)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, roleName := range roleNames {
+		log.LogAttrs(ctx, slog.LevelInfo, "Dropping role",
+			slog.String("user", roleName),
+		)
+		err := prov.DropRole(ctx, roleName)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// dropOwned reassigns the objects owned by the roles in the database to the
+// admin user, and drops their remaining privileges.
+func (p *ConfigProvisioner) dropOwned(ctx context.Context, prov *Provisioner, databaseName string, roleNames []string) error {
+	conn, err := p.openDB(ctx, databaseName, p.cfg.User)
+	if err != nil {
+		return err
+	}
+	defer func(conn Conn) {
+		_ = conn.Close()
+	}(conn)
+	defer p.rollback(ctx, prov)
+
+	dbProv := prov.ForDatabase(databaseName, prov.GetDatabaseOwner(databaseName), conn)
+	for _, roleName := range roleNames {
+		err = dbProv.ReassignOwned(ctx, roleName, p.cfg.User)
+		if err != nil {
+			return err
+		}
+		err = dbProv.DropOwned(ctx, roleName)
+		if err != nil {
+			return err
+		}
+	}
+
+	return prov.Commit()
+}
+
+// rollback rolls back the transaction in progress, if any, before its
+// connection is closed.
+func (p *ConfigProvisioner) rollback(ctx context.Context, prov *Provisioner) {
+	err := prov.Rollback()
+	if err != nil {
+		log.LogAttrs(ctx, slog.LevelWarn, "Failed to roll back transaction",
+			slog.String("error", err.Error()),
+		)
+	}
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		matched, err := path.Match(pattern, name)
+		if (err == nil) && matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *ConfigProvisioner) reconcilePassword(ctx context.Context, prov *Provisioner, user *config.User) error {
+	password, err := p.password(ctx, user)
+	if err != nil {
+		return err
+	}
+	matches, known, err := prov.PasswordMatches(ctx, user.Name, password)
+	if err != nil {
+		return err
+	}
+	if matches {
+		return nil
+	}
+	if !known {
+		log.LogAttrs(ctx, slog.LevelWarn, "Cannot read stored password, re-applying password",
+			slog.String("user", user.Name),
+		)
 	} else {
-		return sql.Open("postgres", dsn)
+		log.LogAttrs(ctx, slog.LevelInfo, "Changing user password",
+			slog.String("user", user.Name),
+		)
 	}
+	return prov.SetPassword(ctx, user.Name, password)
 }
 
-func (p *ConfigProvisioner) buildConnectionString(dbname string, user string, host string, port int, sslmode string) string {
-	userEntry := p.cfg.GetUser(user)
+// password returns the password of the user, resolved through its password
+// source.
+func (p *ConfigProvisioner) password(ctx context.Context, user *config.User) (string, error) {
+	password, ok := p.passwords[user.Name]
+	if ok {
+		return password, nil
+	}
+	password, err := ResolvePassword(ctx, user)
+	if err != nil {
+		return "", err
+	}
+	p.passwords[user.Name] = password
+	return password, nil
+}
+
+func (p *ConfigProvisioner) openDB(ctx context.Context, dbname string, user string) (Conn, error) {
+	if p.connector != nil {
+		return p.connector(ctx, dbname, user)
+	}
 	password := ""
+	userEntry := p.cfg.GetUser(user)
 	if userEntry != nil {
-		password = userEntry.Password
+		var err error
+		password, err = p.password(ctx, userEntry)
+		if err != nil {
+			return nil, err
+		}
+	}
+	dsn := p.buildConnectionString(dbname, user, password, p.cfg.Host, p.cfg.Port, p.cfg.SslMode)
+	var db *sql.DB
+	if p.sshClient != nil {
+		dbConnector := pqssh.NewConnector(p.sshClient, dsn)
+		db = sql.OpenDB(dbConnector)
+	} else {
+		var err error
+		db, err = sql.Open("postgres", dsn)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := p.ping(ctx, db, dbname)
+	if err != nil {
+		_ = db.Close()
+		return nil, err
 	}
+	return NewSQLConn(db), nil
+}
+
+// ping establishes the first connection of db within the connect timeout.
+// Connections through the ssh proxy do not necessarily honour the context, so
+// the ping is abandoned rather than waited for once the context is done.
+func (p *ConfigProvisioner) ping(ctx context.Context, db *sql.DB, dbname string) error {
+	ctx, cancel := p.connectContext(ctx)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- db.PingContext(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("connecting to database %s: %w", dbname, context.Cause(ctx))
+	}
+}
+
+func (p *ConfigProvisioner) buildConnectionString(dbname string, user string, password string, host string, port int, sslmode string) string {
 	if (host == "") && (password == "") {
 		host = "/var/run/postgresql/"
 		port = 0
 	}
-	return BuildConnectionString(dbname, user, password, host, port, sslmode)
+	connStr := BuildConnectionString(dbname, user, password, host, port, sslmode)
+	if p.cfg.ConnectTimeout > 0 {
+		connStr += fmt.Sprintf(" connect_timeout=%d", int(math.Ceil(p.cfg.ConnectTimeout.Seconds())))
+	}
+	if p.cfg.StatementTimeout > 0 {
+		connStr += " options=" + quoteConnectionStringValue(fmt.Sprintf("-c statement_timeout=%d", p.cfg.StatementTimeout.Milliseconds()))
+	}
+	return connStr
 }
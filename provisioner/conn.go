@@ -0,0 +1,139 @@
+package provisioner
+
+import "context"
+
+// Object types of relations that privileges can be granted on in bulk.
+const (
+	ObjectTables    = "TABLES"
+	ObjectSequences = "SEQUENCES"
+)
+
+// Role is a role as read from the catalog.
+type Role struct {
+	Login           bool
+	Superuser       bool
+	CreateDB        bool
+	CreateRole      bool
+	Inherit         bool
+	Replication     bool
+	BypassRLS       bool
+	ConnectionLimit int
+	// System is set for predefined (pg_*) and bootstrap roles.
+	System bool
+}
+
+// Database is a database as read from the catalog.
+type Database struct {
+	Owner            string
+	Encoding         string
+	LcCollate        string
+	LcCtype          string
+	LocaleProvider   string
+	IcuLocale        string
+	Tablespace       string
+	ConnectionLimit  int
+	IsTemplate       bool
+	AllowConnections bool
+}
+
+// Extension is an extension installed in a database.
+type Extension struct {
+	Name    string
+	Schema  string
+	Version string
+}
+
+// Conn is a connection to a database on the server, through which a
+// Provisioner reads the catalog and executes statements. NewSQLConn implements
+// it on top of database/sql, and package fake provides an in-memory
+// implementation for tests.
+//
+// Methods that take a schema apply to the database the connection is connected
+// to. Methods that take an objectType accept ObjectTables or ObjectSequences.
+type Conn interface {
+	// Exec executes a statement.
+	Exec(ctx context.Context, query string) error
+	Close() error
+
+	// Begin starts a transaction. Until it is committed or rolled back, Exec
+	// and the catalog queries run in the transaction.
+	Begin(ctx context.Context) error
+	// Commit commits the transaction started by Begin.
+	Commit() error
+	// Rollback rolls back the transaction started by Begin.
+	Rollback() error
+
+	// TryAdvisoryLock tries to take the session-level advisory lock with the
+	// key, without waiting, and reports whether it was taken. The lock is
+	// held until AdvisoryUnlock or Close.
+	TryAdvisoryLock(ctx context.Context, key int64) (bool, error)
+	// AdvisoryUnlock releases the advisory lock taken by TryAdvisoryLock.
+	AdvisoryUnlock(ctx context.Context, key int64) error
+
+	// ServerVersion returns the server version number, such as 160004.
+	ServerVersion(ctx context.Context) (int, error)
+	// InRecovery reports whether the server is in recovery, such as a standby.
+	InRecovery(ctx context.Context) (bool, error)
+	// CurrentDatabase returns the name of the database connected to.
+	CurrentDatabase(ctx context.Context) (string, error)
+	// Roles returns all roles by name.
+	Roles(ctx context.Context) (map[string]*Role, error)
+	// Databases returns all databases by name.
+	Databases(ctx context.Context) (map[string]*Database, error)
+	// ValidUntilDiffers reports whether the expiry time of the role differs
+	// from validUntil.
+	ValidUntilDiffers(ctx context.Context, roleName string, validUntil string) (bool, error)
+	// Memberships returns the members of the group role. Inherit and Set are
+	// only returned by PostgreSQL 16 or later.
+	Memberships(ctx context.Context, groupName string) ([]*Membership, error)
+	// Settings returns the runtime settings for the role in the database. An
+	// empty databaseName or roleName stands for all databases or all roles.
+	Settings(ctx context.Context, databaseName string, roleName string) (map[string]string, error)
+	// CanReadPasswordVerifiers reports whether the password verifiers in
+	// pg_authid can be read, which usually requires superuser privileges.
+	CanReadPasswordVerifiers(ctx context.Context) (bool, error)
+	// PasswordVerifier returns the password verifier stored for the role, or
+	// an empty string if it has none. If the verifiers cannot be read, it
+	// fails, which aborts the transaction in progress; check
+	// CanReadPasswordVerifiers first.
+	PasswordVerifier(ctx context.Context, roleName string) (string, error)
+	// HasPrivilegesOf reports whether the current user holds the privileges
+	// of the role, as a superuser, or as the role itself or a member
+	// inheriting from it.
+	HasPrivilegesOf(ctx context.Context, roleName string) (bool, error)
+	// ExtensionAvailable reports whether the extension, in the specified
+	// version if not empty, can be installed.
+	ExtensionAvailable(ctx context.Context, name string, version string) (bool, error)
+	// Extensions returns the installed extensions, in lexical order.
+	Extensions(ctx context.Context) ([]Extension, error)
+
+	// SchemaOwner returns the owner of the schema, or an empty string if the
+	// schema does not exist.
+	SchemaOwner(ctx context.Context, schemaName string) (string, error)
+	// SchemaNames returns the names of the schemas, excluding system schemas,
+	// in lexical order.
+	SchemaNames(ctx context.Context) ([]string, error)
+	// SchemaPrivileges returns the privileges granted directly to the role on
+	// the schema.
+	SchemaPrivileges(ctx context.Context, schemaName string, roleName string) ([]string, error)
+	// HasSchemaPrivileges reports whether the role holds all the privileges on
+	// the schema.
+	HasSchemaPrivileges(ctx context.Context, schemaName string, roleName string, privileges []string) (bool, error)
+	// RelationPrivileges returns the privileges granted directly to the role
+	// on any relation of the object type in the schema.
+	RelationPrivileges(ctx context.Context, objectType string, schemaName string, roleName string) ([]string, error)
+	// HasRelationPrivileges reports whether the role holds all the privileges
+	// on every relation of the object type in the schema.
+	HasRelationPrivileges(ctx context.Context, objectType string, schemaName string, roleName string, privileges []string) (bool, error)
+	// DefaultPrivileges returns the default privileges granted to the role on
+	// relations of the object type created in the schema by creatorName, or
+	// by any role if creatorName is empty.
+	DefaultPrivileges(ctx context.Context, objectType string, schemaName string, creatorName string, roleName string) ([]string, error)
+	// DefaultPrivilegeCreators returns the roles whose default privileges in
+	// the schema grant privileges to the role.
+	DefaultPrivilegeCreators(ctx context.Context, schemaName string, roleName string) ([]string, error)
+	// Grantees returns the roles, other than owners, that hold privileges on
+	// the schema, on relations in the schema, or through default privileges
+	// in the schema.
+	Grantees(ctx context.Context, schemaName string) ([]string, error)
+}
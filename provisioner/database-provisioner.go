@@ -0,0 +1,420 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Privileges is a set of privileges granted to a user in a schema. Tables and
+// Sequences are also applied as default privileges for objects created later
+// by the database owner.
+type Privileges struct {
+	Schema    []string
+	Tables    []string
+	Sequences []string
+}
+
+// DefaultProfile is the profile granted to database users that do not specify one.
+const DefaultProfile = "readwrite"
+
+// BuiltinProfiles are the privilege profiles that are available without being
+// declared in the config.
+var BuiltinProfiles = map[string]*Privileges{
+	"readonly": {
+		Schema:    []string{"USAGE"},
+		Tables:    []string{"SELECT"},
+		Sequences: []string{"SELECT"},
+	},
+	"readwrite": {
+		Schema:    []string{"USAGE"},
+		Tables:    []string{"SELECT", "UPDATE", "INSERT", "DELETE"},
+		Sequences: []string{"USAGE", "SELECT"},
+	},
+	"ddl": {
+		Schema:    []string{"USAGE", "CREATE"},
+		Tables:    []string{"SELECT", "UPDATE", "INSERT", "DELETE", "TRUNCATE", "REFERENCES", "TRIGGER"},
+		Sequences: []string{"USAGE", "SELECT", "UPDATE"},
+	},
+}
+
+type relationClass struct {
+	objectType      string
+	privilegesField func(privileges *Privileges) *[]string
+}
+
+var relationClasses = []relationClass{
+	{
+		objectType: ObjectTables,
+		privilegesField: func(privileges *Privileges) *[]string {
+			return &privileges.Tables
+		},
+	},
+	{
+		objectType: ObjectSequences,
+		privilegesField: func(privileges *Privileges) *[]string {
+			return &privileges.Sequences
+		},
+	},
+}
+
+// DatabaseProvisioner provisions objects inside a single database.
+type DatabaseProvisioner struct {
+	p     *Provisioner
+	name  string
+	owner string
+	conn  Conn
+}
+
+// ForDatabase returns a DatabaseProvisioner for the specified database. conn
+// is a connection to that database and may be nil in dry-run mode if the
+// database does not exist yet, in which case nothing is assumed to be granted.
+func (p *Provisioner) ForDatabase(databaseName string, owner string, conn Conn) *DatabaseProvisioner {
+	return &DatabaseProvisioner{
+		p:     p,
+		name:  databaseName,
+		owner: owner,
+		conn:  conn,
+	}
+}
+
+func (dp *DatabaseProvisioner) exec(ctx context.Context, action Action, query string) error {
+	return dp.p.exec(ctx, dp.conn, dp.name, action, query)
+}
+
+// privilegesAction returns the action of granting or revoking privileges in
+// the schema.
+func (dp *DatabaseProvisioner) privilegesAction(schemaName string, userName string, action string) Action {
+	return Action{
+		ObjectType: ObjectTypeSchema,
+		Object:     schemaName,
+		Grantee:    userName,
+		Action:     action,
+	}
+}
+
+// skip records that the schema is up to date, unless an action on it has
+// already been recorded.
+func (dp *DatabaseProvisioner) skip(schemaName string) {
+	dp.p.skip(dp.name, ObjectTypeSchema, schemaName)
+}
+
+// GetSchemaOwner returns the current owner of the specified schema, or an
+// empty string if the schema does not exist.
+func (dp *DatabaseProvisioner) GetSchemaOwner(ctx context.Context, schemaName string) (string, error) {
+	if dp.conn == nil {
+		return "", nil
+	}
+	return dp.conn.SchemaOwner(ctx, schemaName)
+}
+
+func (dp *DatabaseProvisioner) CreateSchema(ctx context.Context, schemaName string, owner string) error {
+	return dp.exec(ctx, Action{ObjectType: ObjectTypeSchema, Object: schemaName, Action: ActionCreated}, fmt.Sprintf("CREATE SCHEMA %s AUTHORIZATION %s", quoteIdentifier(schemaName), quoteIdentifier(owner)))
+}
+
+func (dp *DatabaseProvisioner) SetSchemaOwner(ctx context.Context, schemaName string, owner string) error {
+	return dp.exec(ctx, Action{ObjectType: ObjectTypeSchema, Object: schemaName, Action: ActionAltered}, fmt.Sprintf("ALTER SCHEMA %s OWNER TO %s", quoteIdentifier(schemaName), quoteIdentifier(owner)))
+}
+
+// ReassignOwned reassigns all objects in the database owned by the role to
+// newOwner.
+func (dp *DatabaseProvisioner) ReassignOwned(ctx context.Context, roleName string, newOwner string) error {
+	return dp.exec(ctx, Action{ObjectType: ObjectTypeRole, Object: roleName, Action: ActionAltered}, fmt.Sprintf("REASSIGN OWNED BY %s TO %s", quoteIdentifier(roleName), quoteIdentifier(newOwner)))
+}
+
+// DropOwned drops all objects in the database owned by the role, and revokes
+// all privileges granted to it.
+func (dp *DatabaseProvisioner) DropOwned(ctx context.Context, roleName string) error {
+	return dp.exec(ctx, Action{ObjectType: ObjectTypeRole, Object: roleName, Action: ActionRevoked}, fmt.Sprintf("DROP OWNED BY %s", quoteIdentifier(roleName)))
+}
+
+// SetExtension installs the extension if it is not installed, and updates it
+// to the specified version or moves it to the specified schema if they differ.
+// An empty schema or version leaves it at the server default.
+func (dp *DatabaseProvisioner) SetExtension(ctx context.Context, name string, schemaName string, version string) error {
+	available, err := dp.p.conn.ExtensionAvailable(ctx, name, version)
+	if err != nil {
+		return err
+	}
+	if !available {
+		if version != "" {
+			return fmt.Errorf("extension %s version %s is not available on the server", name, version)
+		}
+		return fmt.Errorf("extension %s is not available on the server", name)
+	}
+
+	var installedVersion string
+	var installedSchema string
+	installed, err := dp.getExtensions(ctx)
+	if err != nil {
+		return err
+	}
+	for _, extension := range installed {
+		if extension.Name == name {
+			installedVersion = extension.Version
+			installedSchema = extension.Schema
+		}
+	}
+
+	if installedVersion == "" {
+		query := fmt.Sprintf("CREATE EXTENSION IF NOT EXISTS %s", quoteIdentifier(name))
+		if schemaName != "" {
+			query += fmt.Sprintf(" SCHEMA %s", quoteIdentifier(schemaName))
+		}
+		if version != "" {
+			query += fmt.Sprintf(" VERSION %s", quoteLiteral(version))
+		}
+		return dp.exec(ctx, Action{ObjectType: ObjectTypeExtension, Object: name, Action: ActionCreated}, query)
+	}
+
+	if ((version == "") || (version == installedVersion)) && ((schemaName == "") || (schemaName == installedSchema)) {
+		dp.p.skip(dp.name, ObjectTypeExtension, name)
+		return nil
+	}
+	if (version != "") && (version != installedVersion) {
+		err = dp.exec(ctx, Action{ObjectType: ObjectTypeExtension, Object: name, Action: ActionAltered}, fmt.Sprintf("ALTER EXTENSION %s UPDATE TO %s", quoteIdentifier(name), quoteLiteral(version)))
+		if err != nil {
+			return err
+		}
+	}
+	if (schemaName != "") && (schemaName != installedSchema) {
+		err = dp.exec(ctx, Action{ObjectType: ObjectTypeExtension, Object: name, Action: ActionAltered}, fmt.Sprintf("ALTER EXTENSION %s SET SCHEMA %s", quoteIdentifier(name), quoteIdentifier(schemaName)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GrantPrivileges grants the specified privileges to the user in the schema,
+// and revokes privileges granted directly to the user that are not specified.
+// Table and sequence privileges are also applied as default privileges for
+// objects created in the schema by each of the creators, which defaults to the
+// database owner.
+func (dp *DatabaseProvisioner) GrantPrivileges(ctx context.Context, schemaName string, userName string, privileges *Privileges, creators []string) error {
+	if len(creators) == 0 {
+		creators = []string{dp.owner}
+	}
+
+	granted, err := dp.hasSchemaPrivileges(ctx, schemaName, userName, privileges.Schema)
+	if err != nil {
+		return err
+	}
+	if !granted {
+		err = dp.exec(ctx, dp.privilegesAction(schemaName, userName, ActionGranted), fmt.Sprintf("GRANT %s ON SCHEMA %s TO %s", strings.Join(privileges.Schema, ", "), quoteIdentifier(schemaName), quoteIdentifier(userName)))
+		if err != nil {
+			return err
+		}
+	}
+	current, err := dp.schemaPrivileges(ctx, schemaName, userName)
+	if err != nil {
+		return err
+	}
+	extra := difference(current, privileges.Schema)
+	if len(extra) > 0 {
+		err = dp.exec(ctx, dp.privilegesAction(schemaName, userName, ActionRevoked), fmt.Sprintf("REVOKE %s ON SCHEMA %s FROM %s", strings.Join(extra, ", "), quoteIdentifier(schemaName), quoteIdentifier(userName)))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, class := range relationClasses {
+		wanted := *class.privilegesField(privileges)
+
+		granted, err = dp.hasRelationPrivileges(ctx, class.objectType, schemaName, userName, wanted)
+		if err != nil {
+			return err
+		}
+		if !granted {
+			err = dp.exec(ctx, dp.privilegesAction(schemaName, userName, ActionGranted), fmt.Sprintf("GRANT %s ON ALL %s IN SCHEMA %s TO %s", strings.Join(wanted, ", "), class.objectType, quoteIdentifier(schemaName), quoteIdentifier(userName)))
+			if err != nil {
+				return err
+			}
+		}
+		current, err = dp.relationPrivileges(ctx, class.objectType, schemaName, userName)
+		if err != nil {
+			return err
+		}
+		extra = difference(current, wanted)
+		if len(extra) > 0 {
+			err = dp.exec(ctx, dp.privilegesAction(schemaName, userName, ActionRevoked), fmt.Sprintf("REVOKE %s ON ALL %s IN SCHEMA %s FROM %s", strings.Join(extra, ", "), class.objectType, quoteIdentifier(schemaName), quoteIdentifier(userName)))
+			if err != nil {
+				return err
+			}
+		}
+
+		for _, creator := range creators {
+			err = dp.setDefaultPrivileges(ctx, class.objectType, schemaName, creator, userName, wanted)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// GetGrantees returns the roles that hold privileges granted directly on the
+// schema, on relations in the schema, or through default privileges in the
+// schema. Owners, whose privileges are implicit, are not included.
+func (dp *DatabaseProvisioner) GetGrantees(ctx context.Context, schemaName string) ([]string, error) {
+	if dp.conn == nil {
+		return nil, nil
+	}
+	return dp.conn.Grantees(ctx, schemaName)
+}
+
+// RevokePrivileges revokes all privileges granted directly to the user on the
+// schema and on relations in the schema, and all default privileges granted
+// to the user in the schema.
+func (dp *DatabaseProvisioner) RevokePrivileges(ctx context.Context, schemaName string, userName string) error {
+	if dp.conn == nil {
+		return nil
+	}
+	creators, err := dp.conn.DefaultPrivilegeCreators(ctx, schemaName, userName)
+	if err != nil {
+		return err
+	}
+	return dp.GrantPrivileges(ctx, schemaName, userName, &Privileges{}, creators)
+}
+
+// GetPrivileges returns the privileges granted directly to the user in the
+// schema. Default privileges granted to the user in the schema count towards
+// the table and sequence privileges.
+func (dp *DatabaseProvisioner) GetPrivileges(ctx context.Context, schemaName string, userName string) (*Privileges, error) {
+	schemaPrivileges, err := dp.schemaPrivileges(ctx, schemaName, userName)
+	if err != nil {
+		return nil, err
+	}
+	privileges := &Privileges{
+		Schema: schemaPrivileges,
+	}
+	for _, class := range relationClasses {
+		current, err := dp.relationPrivileges(ctx, class.objectType, schemaName, userName)
+		if err != nil {
+			return nil, err
+		}
+		defaults, err := dp.defaultPrivileges(ctx, class.objectType, schemaName, "", userName)
+		if err != nil {
+			return nil, err
+		}
+		current = append(current, difference(defaults, current)...)
+		slices.Sort(current)
+		*class.privilegesField(privileges) = current
+	}
+	return privileges, nil
+}
+
+// GetSchemaNames returns the names of the schemas in the database, excluding
+// system schemas, in lexical order.
+func (dp *DatabaseProvisioner) GetSchemaNames(ctx context.Context) ([]string, error) {
+	if dp.conn == nil {
+		return nil, nil
+	}
+	return dp.conn.SchemaNames(ctx)
+}
+
+// GetExtensions returns the extensions installed in the database, except
+// plpgsql which is installed by default, in lexical order.
+func (dp *DatabaseProvisioner) GetExtensions(ctx context.Context) ([]Extension, error) {
+	extensions, err := dp.getExtensions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(extensions, func(extension Extension) bool {
+		return extension.Name == "plpgsql"
+	}), nil
+}
+
+func (dp *DatabaseProvisioner) getExtensions(ctx context.Context) ([]Extension, error) {
+	if dp.conn == nil {
+		return nil, nil
+	}
+	return dp.conn.Extensions(ctx)
+}
+
+func (dp *DatabaseProvisioner) setDefaultPrivileges(ctx context.Context, objectType string, schemaName string, creator string, userName string, wanted []string) error {
+	current, err := dp.defaultPrivileges(ctx, objectType, schemaName, creator, userName)
+	if err != nil {
+		return err
+	}
+	missing := difference(wanted, current)
+	if len(missing) > 0 {
+		err = dp.exec(ctx, dp.privilegesAction(schemaName, userName, ActionGranted), fmt.Sprintf("ALTER DEFAULT PRIVILEGES FOR ROLE %s IN SCHEMA %s GRANT %s ON %s TO %s", quoteIdentifier(creator), quoteIdentifier(schemaName), strings.Join(missing, ", "), objectType, quoteIdentifier(userName)))
+		if err != nil {
+			return err
+		}
+	}
+	extra := difference(current, wanted)
+	if len(extra) > 0 {
+		err = dp.exec(ctx, dp.privilegesAction(schemaName, userName, ActionRevoked), fmt.Sprintf("ALTER DEFAULT PRIVILEGES FOR ROLE %s IN SCHEMA %s REVOKE %s ON %s FROM %s", quoteIdentifier(creator), quoteIdentifier(schemaName), strings.Join(extra, ", "), objectType, quoteIdentifier(userName)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaPrivileges returns the privileges granted directly to the user on the
+// schema.
+func (dp *DatabaseProvisioner) schemaPrivileges(ctx context.Context, schemaName string, userName string) ([]string, error) {
+	if dp.conn == nil {
+		return nil, nil
+	}
+	return dp.conn.SchemaPrivileges(ctx, schemaName, userName)
+}
+
+// relationPrivileges returns the privileges granted directly to the user on
+// any relation of the object type in the schema.
+func (dp *DatabaseProvisioner) relationPrivileges(ctx context.Context, objectType string, schemaName string, userName string) ([]string, error) {
+	if dp.conn == nil {
+		return nil, nil
+	}
+	return dp.conn.RelationPrivileges(ctx, objectType, schemaName, userName)
+}
+
+// defaultPrivileges returns the default privileges granted to the user on
+// relations of the object type created in the schema by the creator, or by
+// any role if creator is empty.
+func (dp *DatabaseProvisioner) defaultPrivileges(ctx context.Context, objectType string, schemaName string, creator string, userName string) ([]string, error) {
+	if dp.conn == nil {
+		return nil, nil
+	}
+	return dp.conn.DefaultPrivileges(ctx, objectType, schemaName, creator, userName)
+}
+
+// hasSchemaPrivileges reports whether the user holds all the specified
+// privileges on the schema. A missing user or schema holds nothing.
+func (dp *DatabaseProvisioner) hasSchemaPrivileges(ctx context.Context, schemaName string, userName string, privileges []string) (bool, error) {
+	if len(privileges) == 0 {
+		return true, nil
+	}
+	if dp.conn == nil {
+		return false, nil
+	}
+	return dp.conn.HasSchemaPrivileges(ctx, schemaName, userName, privileges)
+}
+
+// hasRelationPrivileges reports whether the user holds all the specified
+// privileges on every relation of the object type in the schema.
+func (dp *DatabaseProvisioner) hasRelationPrivileges(ctx context.Context, objectType string, schemaName string, userName string, privileges []string) (bool, error) {
+	if len(privileges) == 0 {
+		return true, nil
+	}
+	if dp.conn == nil {
+		return false, nil
+	}
+	return dp.conn.HasRelationPrivileges(ctx, objectType, schemaName, userName, privileges)
+}
+
+// difference returns the values in a that are not in b.
+func difference(a []string, b []string) []string {
+	result := make([]string, 0)
+	for _, value := range a {
+		if !slices.Contains(b, value) {
+			result = append(result, value)
+		}
+	}
+	return result
+}
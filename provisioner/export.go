@@ -0,0 +1,299 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+
+	"github.com/ngyewch/pq-provisioner/config"
+)
+
+// Export reads the roles, databases, schemas, extensions, settings and
+// privileges on the server and returns them as a config. The connection
+// settings are copied from the config the ConfigProvisioner was created with.
+//
+// Passwords are never exported. Roles that cannot log in and have members are
+// exported as groups, and all other roles as users, except system roles and
+// the admin user. Template databases and the admin database are left out.
+// Privileges are exported as the builtin profile they match, or otherwise as
+// a generated custom profile.
+func (p *ConfigProvisioner) Export(ctx context.Context) (*config.Main, error) {
+	stop := p.closeSSHClientWhenDone(ctx)
+	defer stop()
+
+	conn, err := p.openDB(ctx, p.cfg.Database, p.cfg.User)
+	if err != nil {
+		return nil, err
+	}
+	defer func(conn Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	prov, err := NewDryRunProvisioner(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &config.Main{
+		Database: p.cfg.Database,
+		User:     p.cfg.User,
+		Host:     p.cfg.Host,
+		Port:     p.cfg.Port,
+		SslMode:  p.cfg.SslMode,
+		SshProxy: p.cfg.SshProxy,
+
+		ConnectTimeout:   p.cfg.ConnectTimeout,
+		StatementTimeout: p.cfg.StatementTimeout,
+		Lock:             p.cfg.Lock,
+
+		AllowMD5Passwords: p.cfg.AllowMD5Passwords,
+	}
+
+	for _, roleName := range prov.RoleNames() {
+		if prov.IsSystemRole(roleName) || (roleName == p.cfg.User) {
+			continue
+		}
+		attributes := prov.GetRoleAttributes(roleName)
+		memberships, err := prov.GetMemberships(ctx, roleName)
+		if err != nil {
+			return nil, err
+		}
+		if !*attributes.Login && (len(memberships) > 0) {
+			group := &config.Group{
+				Name: roleName,
+			}
+			for _, membership := range memberships {
+				group.Members = append(group.Members, &config.Member{
+					Name:    membership.Member,
+					Admin:   membership.Admin,
+					Inherit: membership.Inherit,
+					Set:     membership.Set,
+				})
+			}
+			cfg.Groups = append(cfg.Groups, group)
+			continue
+		}
+		settings, err := prov.GetSettings(ctx, "", roleName)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Users = append(cfg.Users, exportUser(roleName, attributes, settings))
+	}
+
+	for _, databaseName := range prov.DatabaseNames() {
+		if prov.IsTemplateDatabase(databaseName) || (databaseName == prov.CurrentDatabase()) {
+			continue
+		}
+		log.LogAttrs(ctx, slog.LevelInfo, "Exporting database",
+			slog.String("dbname", databaseName),
+		)
+		database, err := p.exportDatabase(ctx, prov, cfg, databaseName)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Databases = append(cfg.Databases, database)
+	}
+
+	return cfg, nil
+}
+
+// exportUser returns the config for a user. Attributes that are at their
+// default values are left out.
+func exportUser(name string, attributes *RoleAttributes, settings map[string]string) *config.User {
+	user := &config.User{
+		Name: name,
+	}
+	if !*attributes.Login {
+		user.Login = attributes.Login
+	}
+	if *attributes.Superuser {
+		user.Superuser = attributes.Superuser
+	}
+	if *attributes.CreateDB {
+		user.CreateDB = attributes.CreateDB
+	}
+	if *attributes.CreateRole {
+		user.CreateRole = attributes.CreateRole
+	}
+	if !*attributes.Inherit {
+		user.Inherit = attributes.Inherit
+	}
+	if *attributes.Replication {
+		user.Replication = attributes.Replication
+	}
+	if *attributes.BypassRLS {
+		user.BypassRLS = attributes.BypassRLS
+	}
+	if *attributes.ConnectionLimit != -1 {
+		user.ConnectionLimit = attributes.ConnectionLimit
+	}
+	if len(settings) > 0 {
+		user.Settings = settings
+	}
+	return user
+}
+
+// exportDatabase returns the config for a database. The database is only
+// connected to if it allows connections. Profiles that do not match a builtin
+// profile are added to cfg.
+func (p *ConfigProvisioner) exportDatabase(ctx context.Context, prov *Provisioner, cfg *config.Main, databaseName string) (*config.Database, error) {
+	options := prov.GetDatabaseOptions(databaseName)
+	database := &config.Database{
+		Name:      databaseName,
+		Owner:     prov.GetDatabaseOwner(databaseName),
+		Encoding:  options.Encoding,
+		LcCollate: options.LcCollate,
+		LcCtype:   options.LcCtype,
+	}
+	if options.LocaleProvider != "libc" {
+		database.LocaleProvider = options.LocaleProvider
+		database.IcuLocale = options.IcuLocale
+	}
+	if options.Tablespace != "pg_default" {
+		database.Tablespace = options.Tablespace
+	}
+	if *options.ConnectionLimit != -1 {
+		database.ConnectionLimit = options.ConnectionLimit
+	}
+	if !*options.AllowConnections {
+		database.AllowConnections = options.AllowConnections
+		return database, nil
+	}
+
+	settings, err := prov.GetSettings(ctx, databaseName, "")
+	if err != nil {
+		return nil, err
+	}
+	if len(settings) > 0 {
+		database.Settings = settings
+	}
+
+	conn, err := p.openDB(ctx, databaseName, p.cfg.User)
+	if err != nil {
+		return nil, err
+	}
+	defer func(conn Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	dbProv := prov.ForDatabase(databaseName, database.Owner, conn)
+
+	extensions, err := dbProv.GetExtensions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, extension := range extensions {
+		database.Extensions = append(database.Extensions, &config.Extension{
+			Name:    extension.Name,
+			Schema:  extension.Schema,
+			Version: extension.Version,
+		})
+	}
+
+	schemaNames, err := dbProv.GetSchemaNames(ctx)
+	if err != nil {
+		return nil, err
+	}
+	schemas := make([]*config.Schema, 0)
+	for _, schemaName := range schemaNames {
+		schema := &config.Schema{
+			Name: schemaName,
+		}
+		owner, err := dbProv.GetSchemaOwner(ctx, schemaName)
+		if err != nil {
+			return nil, err
+		}
+		if (owner != database.Owner) && !prov.IsSystemRole(owner) {
+			schema.Owner = owner
+		}
+		grantees, err := dbProv.GetGrantees(ctx, schemaName)
+		if err != nil {
+			return nil, err
+		}
+		for _, grantee := range grantees {
+			if (grantee == p.cfg.User) || prov.IsSystemRole(grantee) {
+				continue
+			}
+			privileges, err := dbProv.GetPrivileges(ctx, schemaName, grantee)
+			if err != nil {
+				return nil, err
+			}
+			schema.Users = append(schema.Users, &config.DatabaseUser{
+				Name:    grantee,
+				Profile: exportProfile(cfg, privileges),
+			})
+		}
+		schemas = append(schemas, schema)
+	}
+
+	// Users with the same privileges in every schema are declared once for
+	// the database, otherwise each schema declares its own users.
+	if (len(schemas) > 0) && !slices.ContainsFunc(schemas, func(schema *config.Schema) bool {
+		return !slices.EqualFunc(schema.Users, schemas[0].Users, func(a *config.DatabaseUser, b *config.DatabaseUser) bool {
+			return (a.Name == b.Name) && (a.Profile == b.Profile)
+		})
+	}) {
+		database.Users = schemas[0].Users
+		for _, schema := range schemas {
+			schema.Users = nil
+		}
+	}
+
+	for _, user := range database.Users {
+		settings, err = prov.GetSettings(ctx, databaseName, user.Name)
+		if err != nil {
+			return nil, err
+		}
+		if len(settings) > 0 {
+			user.Settings = settings
+		}
+	}
+
+	for _, schema := range schemas {
+		if (schema.Name == "public") && (schema.Owner == "") && (len(schema.Users) == 0) {
+			continue
+		}
+		database.Schemas = append(database.Schemas, schema)
+	}
+
+	return database, nil
+}
+
+// exportProfile returns the name of the profile granting exactly the
+// privileges. The default profile is returned as an empty name. If no builtin
+// or previously exported profile matches, a new profile is added to cfg.
+func exportProfile(cfg *config.Main, privileges *Privileges) string {
+	matches := func(schema []string, tables []string, sequences []string) bool {
+		return sameElements(schema, privileges.Schema) &&
+			sameElements(tables, privileges.Tables) &&
+			sameElements(sequences, privileges.Sequences)
+	}
+	if matches(BuiltinProfiles[DefaultProfile].Schema, BuiltinProfiles[DefaultProfile].Tables, BuiltinProfiles[DefaultProfile].Sequences) {
+		return ""
+	}
+	for _, name := range []string{"readonly", "ddl"} {
+		if matches(BuiltinProfiles[name].Schema, BuiltinProfiles[name].Tables, BuiltinProfiles[name].Sequences) {
+			return name
+		}
+	}
+	for _, profile := range cfg.Profiles {
+		if matches(profile.Schema, profile.Tables, profile.Sequences) {
+			return profile.Name
+		}
+	}
+	profile := &config.Profile{
+		Name:      fmt.Sprintf("profile%d", len(cfg.Profiles)+1),
+		Schema:    privileges.Schema,
+		Tables:    privileges.Tables,
+		Sequences: privileges.Sequences,
+	}
+	cfg.Profiles = append(cfg.Profiles, profile)
+	return profile.Name
+}
+
+// sameElements reports whether a and b contain the same values, regardless of
+// order.
+func sameElements(a []string, b []string) bool {
+	return (len(difference(a, b)) == 0) && (len(difference(b, a)) == 0)
+}
@@ -0,0 +1,498 @@
+package fake
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"github.com/ngyewch/pq-provisioner/provisioner"
+)
+
+type conn struct {
+	server   *Server
+	database string
+	user     string
+	closed   bool
+	// snapshot is the state of the server when the transaction in progress
+	// began, or nil if there is none.
+	snapshot *state
+	// aborted is set when a statement of the transaction in progress fails.
+	aborted bool
+}
+
+// errAborted is returned for statements issued in a transaction after one of
+// its statements failed, until it is rolled back.
+var errAborted = errors.New("current transaction is aborted, commands ignored until end of transaction block")
+
+// lock locks the server, unless the context is done or the connection is
+// closed.
+func (c *conn) lock(ctx context.Context) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	c.server.mu.Lock()
+	if c.closed {
+		c.server.mu.Unlock()
+		return fmt.Errorf("connection is closed")
+	}
+	return nil
+}
+
+func (c *conn) unlock() {
+	c.server.mu.Unlock()
+}
+
+// query locks the server for a statement or catalog query, unless the
+// transaction in progress has failed.
+func (c *conn) query(ctx context.Context) error {
+	err := c.lock(ctx)
+	if err != nil {
+		return err
+	}
+	if c.aborted {
+		c.unlock()
+		return errAborted
+	}
+	return nil
+}
+
+// fail marks the transaction in progress, if any, as failed, like a server
+// does when a statement fails, and returns err.
+func (c *conn) fail(err error) error {
+	if c.snapshot != nil {
+		c.aborted = true
+	}
+	return err
+}
+
+// currentSchema returns the schema in the database connected to, or nil if
+// it does not exist.
+func (c *conn) currentSchema(schemaName string) *schema {
+	d, ok := c.server.databases[c.database]
+	if !ok {
+		return nil
+	}
+	return d.schemas[schemaName]
+}
+
+func (c *conn) Close() error {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	if c.snapshot != nil {
+		c.server.state = *c.snapshot
+		c.snapshot = nil
+		c.aborted = false
+	}
+	c.terminate()
+	return nil
+}
+
+// terminate closes the connection and releases its advisory locks. The server
+// must be locked. The statements of a transaction in progress are not rolled
+// back.
+func (c *conn) terminate() {
+	maps.DeleteFunc(c.server.advisoryLocks, func(key advisoryLockKey, holder *conn) bool {
+		return holder == c
+	})
+	delete(c.server.conns, c)
+	c.snapshot = nil
+	c.aborted = false
+	c.closed = true
+}
+
+func (c *conn) TryAdvisoryLock(ctx context.Context, key int64) (bool, error) {
+	err := c.lock(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer c.unlock()
+	lockKey := advisoryLockKey{database: c.database, key: key}
+	holder, ok := c.server.advisoryLocks[lockKey]
+	if ok && (holder != c) {
+		return false, nil
+	}
+	c.server.advisoryLocks[lockKey] = c
+	return true, nil
+}
+
+func (c *conn) AdvisoryUnlock(ctx context.Context, key int64) error {
+	err := c.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.unlock()
+	lockKey := advisoryLockKey{database: c.database, key: key}
+	if c.server.advisoryLocks[lockKey] != c {
+		return fmt.Errorf("advisory lock %d is not held", key)
+	}
+	delete(c.server.advisoryLocks, lockKey)
+	return nil
+}
+
+func (c *conn) Begin(ctx context.Context) error {
+	err := c.lock(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.unlock()
+	if c.snapshot != nil {
+		return fmt.Errorf("there is already a transaction in progress")
+	}
+	c.snapshot = c.server.state.clone()
+	return nil
+}
+
+func (c *conn) Commit() error {
+	err := c.lock(context.Background())
+	if err != nil {
+		return err
+	}
+	defer c.unlock()
+	if c.snapshot == nil {
+		return fmt.Errorf("there is no transaction in progress")
+	}
+	if c.aborted {
+		c.server.state = *c.snapshot
+		c.snapshot = nil
+		c.aborted = false
+		return fmt.Errorf("transaction was rolled back: %w", errAborted)
+	}
+	c.snapshot = nil
+	return nil
+}
+
+func (c *conn) Rollback() error {
+	err := c.lock(context.Background())
+	if err != nil {
+		return err
+	}
+	defer c.unlock()
+	if c.snapshot == nil {
+		return fmt.Errorf("there is no transaction in progress")
+	}
+	c.server.state = *c.snapshot
+	c.snapshot = nil
+	c.aborted = false
+	return nil
+}
+
+func (c *conn) ServerVersion(ctx context.Context) (int, error) {
+	err := c.query(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer c.unlock()
+	return c.server.version, nil
+}
+
+func (c *conn) InRecovery(ctx context.Context) (bool, error) {
+	err := c.query(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer c.unlock()
+	return c.server.inRecovery, nil
+}
+
+func (c *conn) CurrentDatabase(ctx context.Context) (string, error) {
+	err := c.query(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer c.unlock()
+	return c.database, nil
+}
+
+func (c *conn) Roles(ctx context.Context) (map[string]*provisioner.Role, error) {
+	err := c.query(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unlock()
+	roles := make(map[string]*provisioner.Role)
+	for name, r := range c.server.roles {
+		copied := r.Role
+		roles[name] = &copied
+	}
+	return roles, nil
+}
+
+func (c *conn) Databases(ctx context.Context) (map[string]*provisioner.Database, error) {
+	err := c.query(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unlock()
+	databases := make(map[string]*provisioner.Database)
+	for name, d := range c.server.databases {
+		copied := d.Database
+		databases[name] = &copied
+	}
+	return databases, nil
+}
+
+func (c *conn) ValidUntilDiffers(ctx context.Context, roleName string, validUntil string) (bool, error) {
+	err := c.query(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer c.unlock()
+	r, ok := c.server.roles[roleName]
+	if !ok {
+		return true, nil
+	}
+	return r.validUntil != validUntil, nil
+}
+
+func (c *conn) Memberships(ctx context.Context, groupName string) ([]*provisioner.Membership, error) {
+	err := c.query(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unlock()
+	members := c.server.memberships[groupName]
+	memberships := make([]*provisioner.Membership, 0, len(members))
+	for _, member := range slices.Sorted(maps.Keys(members)) {
+		membership := *members[member]
+		memberships = append(memberships, &membership)
+	}
+	return memberships, nil
+}
+
+func (c *conn) Settings(ctx context.Context, databaseName string, roleName string) (map[string]string, error) {
+	err := c.query(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unlock()
+	return maps.Clone(c.server.settings[settingsKey{database: databaseName, role: roleName}]), nil
+}
+
+func (c *conn) CanReadPasswordVerifiers(ctx context.Context) (bool, error) {
+	err := c.query(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer c.unlock()
+	return c.server.roles[c.user].Superuser, nil
+}
+
+// PasswordVerifier fails unless connected as a superuser, like reading
+// pg_authid.
+func (c *conn) PasswordVerifier(ctx context.Context, roleName string) (string, error) {
+	err := c.query(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer c.unlock()
+	if !c.server.roles[c.user].Superuser {
+		return "", c.fail(fmt.Errorf("permission denied for table pg_authid"))
+	}
+	r, ok := c.server.roles[roleName]
+	if !ok {
+		return "", nil
+	}
+	return r.password, nil
+}
+
+func (c *conn) HasPrivilegesOf(ctx context.Context, roleName string) (bool, error) {
+	err := c.query(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer c.unlock()
+	if _, ok := c.server.roles[roleName]; !ok {
+		return false, c.fail(fmt.Errorf("role %q does not exist", roleName))
+	}
+	return c.server.hasPrivilegesOf(c.user, roleName), nil
+}
+
+func (c *conn) ExtensionAvailable(ctx context.Context, name string, version string) (bool, error) {
+	err := c.query(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer c.unlock()
+	versions, ok := c.server.available[name]
+	return ok && ((version == "") || slices.Contains(versions, version)), nil
+}
+
+func (c *conn) Extensions(ctx context.Context) ([]provisioner.Extension, error) {
+	err := c.query(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unlock()
+	extensions := make([]provisioner.Extension, 0)
+	d, ok := c.server.databases[c.database]
+	if !ok {
+		return extensions, nil
+	}
+	for _, name := range slices.Sorted(maps.Keys(d.extensions)) {
+		extensions = append(extensions, *d.extensions[name])
+	}
+	return extensions, nil
+}
+
+func (c *conn) SchemaOwner(ctx context.Context, schemaName string) (string, error) {
+	err := c.query(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer c.unlock()
+	sch := c.currentSchema(schemaName)
+	if sch == nil {
+		return "", nil
+	}
+	return sch.owner, nil
+}
+
+func (c *conn) SchemaNames(ctx context.Context) ([]string, error) {
+	err := c.query(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unlock()
+	d, ok := c.server.databases[c.database]
+	if !ok {
+		return nil, nil
+	}
+	return slices.Sorted(maps.Keys(d.schemas)), nil
+}
+
+func (c *conn) SchemaPrivileges(ctx context.Context, schemaName string, roleName string) ([]string, error) {
+	err := c.query(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unlock()
+	sch := c.currentSchema(schemaName)
+	if sch == nil {
+		return nil, nil
+	}
+	return slices.Clone(sch.privileges[roleName]), nil
+}
+
+func (c *conn) HasSchemaPrivileges(ctx context.Context, schemaName string, roleName string, privileges []string) (bool, error) {
+	err := c.query(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer c.unlock()
+	sch := c.currentSchema(schemaName)
+	if sch == nil {
+		return false, nil
+	}
+	return c.server.hasPrivileges(roleName, sch.owner, sch.privileges, privileges), nil
+}
+
+func (c *conn) RelationPrivileges(ctx context.Context, objectType string, schemaName string, roleName string) ([]string, error) {
+	err := c.query(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unlock()
+	sch := c.currentSchema(schemaName)
+	if sch == nil {
+		return nil, nil
+	}
+	return slices.Clone(sch.relationPrivileges[objectType][roleName]), nil
+}
+
+func (c *conn) HasRelationPrivileges(ctx context.Context, objectType string, schemaName string, roleName string, privileges []string) (bool, error) {
+	err := c.query(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer c.unlock()
+	sch := c.currentSchema(schemaName)
+	if sch == nil {
+		return true, nil
+	}
+	return c.server.hasPrivileges(roleName, sch.owner, sch.relationPrivileges[objectType], privileges), nil
+}
+
+func (c *conn) DefaultPrivileges(ctx context.Context, objectType string, schemaName string, creatorName string, roleName string) ([]string, error) {
+	err := c.query(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unlock()
+	sch := c.currentSchema(schemaName)
+	if sch == nil {
+		return nil, nil
+	}
+	privileges := make([]string, 0)
+	for creator, grants := range sch.defaultPrivileges[objectType] {
+		if (creatorName != "") && (creator != creatorName) {
+			continue
+		}
+		for _, privilege := range grants[roleName] {
+			if !slices.Contains(privileges, privilege) {
+				privileges = append(privileges, privilege)
+			}
+		}
+	}
+	slices.Sort(privileges)
+	return privileges, nil
+}
+
+func (c *conn) DefaultPrivilegeCreators(ctx context.Context, schemaName string, roleName string) ([]string, error) {
+	err := c.query(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unlock()
+	sch := c.currentSchema(schemaName)
+	if sch == nil {
+		return nil, nil
+	}
+	creators := make([]string, 0)
+	for _, byCreator := range sch.defaultPrivileges {
+		for creator, grants := range byCreator {
+			if (len(grants[roleName]) > 0) && !slices.Contains(creators, creator) {
+				creators = append(creators, creator)
+			}
+		}
+	}
+	slices.Sort(creators)
+	return creators, nil
+}
+
+func (c *conn) Grantees(ctx context.Context, schemaName string) ([]string, error) {
+	err := c.query(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer c.unlock()
+	sch := c.currentSchema(schemaName)
+	if sch == nil {
+		return nil, nil
+	}
+	grantees := make([]string, 0)
+	add := func(grantee string, owner string) {
+		if (grantee != owner) && !slices.Contains(grantees, grantee) {
+			grantees = append(grantees, grantee)
+		}
+	}
+	for grantee := range sch.privileges {
+		add(grantee, sch.owner)
+	}
+	for _, grants := range sch.relationPrivileges {
+		for grantee := range grants {
+			add(grantee, sch.owner)
+		}
+	}
+	for _, byCreator := range sch.defaultPrivileges {
+		for creator, grants := range byCreator {
+			for grantee := range grants {
+				add(grantee, creator)
+			}
+		}
+	}
+	slices.Sort(grantees)
+	return grantees, nil
+}
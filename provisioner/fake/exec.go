@@ -0,0 +1,941 @@
+package fake
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"strings"
+
+	"github.com/ngyewch/pq-provisioner/provisioner"
+)
+
+// Exec executes one of the statements issued by a Provisioner. SELECT
+// statements are accepted and ignored. If the statement fails, the
+// transaction in progress fails too.
+func (c *conn) Exec(ctx context.Context, query string) error {
+	err := c.query(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.unlock()
+
+	tokens, err := tokenize(query)
+	if err != nil {
+		return c.fail(err)
+	}
+	p := &parser{tokens: tokens}
+	if c.server.inRecovery && !p.accept("SELECT") {
+		return c.fail(fmt.Errorf("cannot execute statement in a read-only transaction"))
+	}
+	switch {
+	case p.accept("SELECT"):
+		err = nil
+	case p.accept("CREATE", "USER"):
+		err = c.createRole(p, true)
+	case p.accept("CREATE", "ROLE"):
+		err = c.createRole(p, false)
+	case p.accept("ALTER", "ROLE"):
+		err = c.alterRole(p)
+	case p.accept("DROP", "ROLE"):
+		err = c.dropRole(p)
+	case p.accept("CREATE", "DATABASE"):
+		err = c.outsideTransaction("CREATE DATABASE")
+		if err == nil {
+			err = c.createDatabase(p)
+		}
+	case p.accept("ALTER", "DATABASE"):
+		err = c.alterDatabase(p)
+	case p.accept("DROP", "DATABASE"):
+		err = c.outsideTransaction("DROP DATABASE")
+		if err == nil {
+			err = c.dropDatabase(p)
+		}
+	case p.accept("CREATE", "SCHEMA"):
+		err = c.createSchema(p)
+	case p.accept("ALTER", "SCHEMA"):
+		err = c.alterSchema(p)
+	case p.accept("CREATE", "EXTENSION"):
+		err = c.createExtension(p)
+	case p.accept("ALTER", "EXTENSION"):
+		err = c.alterExtension(p)
+	case p.accept("ALTER", "DEFAULT", "PRIVILEGES"):
+		err = c.alterDefaultPrivileges(p)
+	case p.accept("GRANT"):
+		err = c.grantOrRevoke(p, true)
+	case p.accept("REVOKE"):
+		err = c.grantOrRevoke(p, false)
+	case p.accept("REASSIGN", "OWNED", "BY"):
+		err = c.reassignOwned(p)
+	case p.accept("DROP", "OWNED", "BY"):
+		err = c.dropOwned(p)
+	default:
+		err = fmt.Errorf("unsupported statement: %s", query)
+	}
+	if err != nil {
+		return c.fail(err)
+	}
+	c.server.statements = append(c.server.statements, query)
+	return nil
+}
+
+// outsideTransaction returns an error if a transaction is in progress, for
+// statements that cannot run in a transaction block.
+func (c *conn) outsideTransaction(statement string) error {
+	if c.snapshot != nil {
+		return fmt.Errorf("%s cannot run inside a transaction block", statement)
+	}
+	return nil
+}
+
+func (c *conn) role(name string) (*role, error) {
+	r, ok := c.server.roles[name]
+	if !ok {
+		return nil, fmt.Errorf("role %q does not exist", name)
+	}
+	return r, nil
+}
+
+// canManageRole returns an error unless the user connected as may create,
+// alter, drop or grant membership in the role: superusers may manage any role,
+// and roles with CREATEROLE may manage roles other than superusers. From
+// PostgreSQL 16, they must also hold the ADMIN option on the role.
+func (c *conn) canManageRole(name string) error {
+	current := c.server.roles[c.user]
+	if current.Superuser {
+		return nil
+	}
+	r, ok := c.server.roles[name]
+	if !current.CreateRole || (ok && r.Superuser) {
+		return fmt.Errorf("permission denied to manage role %q", name)
+	}
+	if ok && (c.server.version >= 160000) {
+		membership, ok := c.server.memberships[name][c.user]
+		if !ok || !membership.Admin {
+			return fmt.Errorf("permission denied to manage role %q: must have the ADMIN option on it", name)
+		}
+	}
+	return nil
+}
+
+func (c *conn) schema(name string) (*schema, error) {
+	sch := c.currentSchema(name)
+	if sch == nil {
+		return nil, fmt.Errorf("schema %q does not exist", name)
+	}
+	return sch, nil
+}
+
+func (c *conn) createRole(p *parser, login bool) error {
+	name, err := p.identifier()
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(name, "pg_") || (name == "public") || (name == "none") {
+		return fmt.Errorf("role name %q is reserved", name)
+	}
+	if _, ok := c.server.roles[name]; ok {
+		return fmt.Errorf("role %q already exists", name)
+	}
+	err = c.canManageRole(name)
+	if err != nil {
+		return err
+	}
+	r := &role{
+		Role: provisioner.Role{
+			Login:           login,
+			Inherit:         true,
+			ConnectionLimit: -1,
+		},
+	}
+	if p.accept("WITH") {
+		err = parseRoleOptions(p, name, r)
+		if err != nil {
+			return err
+		}
+	}
+	if !p.done() {
+		return p.syntaxError()
+	}
+	if r.Superuser && !c.server.roles[c.user].Superuser {
+		return fmt.Errorf("permission denied to create role %q: must be superuser to create superusers", name)
+	}
+	c.server.roles[name] = r
+	c.selfGrant(name)
+	return nil
+}
+
+// selfGrant grants a role created by a non-superuser to its creator with the
+// ADMIN option, as PostgreSQL 16 and later do, with the INHERIT and SET
+// options of the default, empty createrole_self_grant.
+func (c *conn) selfGrant(name string) {
+	if (c.server.version < 160000) || c.server.roles[c.user].Superuser {
+		return
+	}
+	inherit := false
+	set := false
+	c.server.memberships[name] = map[string]*provisioner.Membership{
+		c.user: {
+			Member:  c.user,
+			Admin:   true,
+			Inherit: &inherit,
+			Set:     &set,
+		},
+	}
+}
+
+func parseRoleOptions(p *parser, name string, r *role) error {
+	flags := []struct {
+		on    string
+		off   string
+		field *bool
+	}{
+		{"LOGIN", "NOLOGIN", &r.Login},
+		{"SUPERUSER", "NOSUPERUSER", &r.Superuser},
+		{"CREATEDB", "NOCREATEDB", &r.CreateDB},
+		{"CREATEROLE", "NOCREATEROLE", &r.CreateRole},
+		{"INHERIT", "NOINHERIT", &r.Inherit},
+		{"REPLICATION", "NOREPLICATION", &r.Replication},
+		{"BYPASSRLS", "NOBYPASSRLS", &r.BypassRLS},
+	}
+options:
+	for !p.done() {
+		for _, flag := range flags {
+			if p.accept(flag.on) {
+				*flag.field = true
+				continue options
+			}
+			if p.accept(flag.off) {
+				*flag.field = false
+				continue options
+			}
+		}
+		switch {
+		case p.accept("CONNECTION", "LIMIT"):
+			limit, err := p.number()
+			if err != nil {
+				return err
+			}
+			r.ConnectionLimit = limit
+		case p.accept("VALID", "UNTIL"):
+			validUntil, err := p.literal()
+			if err != nil {
+				return err
+			}
+			r.validUntil = validUntil
+		case p.accept("PASSWORD", "NULL"):
+			r.password = ""
+		case p.accept("PASSWORD"):
+			password, err := p.literal()
+			if err != nil {
+				return err
+			}
+			r.setPassword(name, password)
+		default:
+			return p.syntaxError()
+		}
+	}
+	return nil
+}
+
+func (c *conn) alterRole(p *parser) error {
+	name, err := p.identifier()
+	if err != nil {
+		return err
+	}
+	r, err := c.role(name)
+	if err != nil {
+		return err
+	}
+	if name != c.user {
+		err = c.canManageRole(name)
+		if err != nil {
+			return err
+		}
+	}
+	if p.accept("WITH") {
+		updated := *r
+		err = parseRoleOptions(p, name, &updated)
+		if err != nil {
+			return err
+		}
+		if (updated.Superuser != r.Superuser) && !c.server.roles[c.user].Superuser {
+			return fmt.Errorf("permission denied to alter role %q: must be superuser to change the SUPERUSER attribute", name)
+		}
+		*r = updated
+		return nil
+	}
+	databaseName := ""
+	if p.accept("IN", "DATABASE") {
+		databaseName, err = p.identifier()
+		if err != nil {
+			return err
+		}
+		if _, ok := c.server.databases[databaseName]; !ok {
+			return fmt.Errorf("database %q does not exist", databaseName)
+		}
+	}
+	return c.setOrReset(p, settingsKey{database: databaseName, role: name})
+}
+
+// setOrReset parses and applies SET name = value and RESET name.
+func (c *conn) setOrReset(p *parser, key settingsKey) error {
+	if p.accept("RESET") {
+		name, err := p.qualifiedName()
+		if err != nil {
+			return err
+		}
+		if !p.done() {
+			return p.syntaxError()
+		}
+		delete(c.server.settings[key], name)
+		if len(c.server.settings[key]) == 0 {
+			delete(c.server.settings, key)
+		}
+		return nil
+	}
+	err := p.expect("SET")
+	if err != nil {
+		return err
+	}
+	name, err := p.qualifiedName()
+	if err != nil {
+		return err
+	}
+	if !p.accept("=") {
+		err = p.expect("TO")
+		if err != nil {
+			return err
+		}
+	}
+	values, err := p.literalList()
+	if err != nil {
+		return err
+	}
+	if !p.done() {
+		return p.syntaxError()
+	}
+	if c.server.settings[key] == nil {
+		c.server.settings[key] = make(map[string]string)
+	}
+	c.server.settings[key][name] = strings.Join(values, ", ")
+	return nil
+}
+
+func (c *conn) dropRole(p *parser) error {
+	name, err := p.identifier()
+	if err != nil {
+		return err
+	}
+	_, err = c.role(name)
+	if err != nil {
+		return err
+	}
+	err = c.canManageRole(name)
+	if err != nil {
+		return err
+	}
+	if c.server.ownsObjects(name) {
+		return fmt.Errorf("role %q cannot be dropped because some objects depend on it", name)
+	}
+	delete(c.server.roles, name)
+	delete(c.server.memberships, name)
+	for _, members := range c.server.memberships {
+		delete(members, name)
+	}
+	for key := range c.server.settings {
+		if key.role == name {
+			delete(c.server.settings, key)
+		}
+	}
+	return nil
+}
+
+func (c *conn) createDatabase(p *parser) error {
+	name, err := p.identifier()
+	if err != nil {
+		return err
+	}
+	if _, ok := c.server.databases[name]; ok {
+		return fmt.Errorf("database %q already exists", name)
+	}
+	current := c.server.roles[c.user]
+	if !current.Superuser && !current.CreateDB {
+		return fmt.Errorf("permission denied to create database")
+	}
+	d := c.server.newDatabase(c.user)
+	if p.accept("WITH") {
+		err = c.parseDatabaseOptions(p, d, true)
+		if err != nil {
+			return err
+		}
+	}
+	c.server.databases[name] = d
+	return nil
+}
+
+func (c *conn) parseDatabaseOptions(p *parser, d *database, create bool) error {
+	for !p.done() {
+		var err error
+		switch {
+		case p.accept("CONNECTION", "LIMIT"):
+			d.ConnectionLimit, err = p.number()
+		case p.accept("IS_TEMPLATE"):
+			d.IsTemplate, err = p.boolean()
+		case p.accept("ALLOW_CONNECTIONS"):
+			d.AllowConnections, err = p.boolean()
+		case create && p.accept("TEMPLATE"):
+			var template string
+			template, err = p.identifier()
+			if (err == nil) && (c.server.databases[template] == nil) {
+				err = fmt.Errorf("template database %q does not exist", template)
+			}
+		case create && p.accept("OWNER"):
+			d.Owner, err = p.identifier()
+		case create && p.accept("ENCODING"):
+			d.Encoding, err = p.literal()
+		case create && p.accept("LC_COLLATE"):
+			d.LcCollate, err = p.literal()
+		case create && p.accept("LC_CTYPE"):
+			d.LcCtype, err = p.literal()
+		case create && p.accept("LOCALE_PROVIDER"):
+			d.LocaleProvider, err = p.identifier()
+		case create && p.accept("ICU_LOCALE"):
+			d.IcuLocale, err = p.literal()
+		case create && p.accept("TABLESPACE"):
+			d.Tablespace, err = p.identifier()
+		default:
+			err = p.syntaxError()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *conn) alterDatabase(p *parser) error {
+	name, err := p.identifier()
+	if err != nil {
+		return err
+	}
+	d, ok := c.server.databases[name]
+	if !ok {
+		return fmt.Errorf("database %q does not exist", name)
+	}
+	if p.accept("OWNER", "TO") {
+		owner, err := p.identifier()
+		if err != nil {
+			return err
+		}
+		_, err = c.role(owner)
+		if err != nil {
+			return err
+		}
+		d.Owner = owner
+		return nil
+	}
+	if p.accept("WITH") {
+		updated := *d
+		err = c.parseDatabaseOptions(p, &updated, false)
+		if err != nil {
+			return err
+		}
+		*d = updated
+		return nil
+	}
+	return c.setOrReset(p, settingsKey{database: name})
+}
+
+func (c *conn) dropDatabase(p *parser) error {
+	name, err := p.identifier()
+	if err != nil {
+		return err
+	}
+	force := false
+	if p.accept("WITH") {
+		err = p.expect("(", "FORCE", ")")
+		if err != nil {
+			return err
+		}
+		force = true
+	}
+	if !p.done() {
+		return p.syntaxError()
+	}
+	if _, ok := c.server.databases[name]; !ok {
+		return fmt.Errorf("database %q does not exist", name)
+	}
+	if name == c.database {
+		return fmt.Errorf("cannot drop the currently open database")
+	}
+	for other := range c.server.conns {
+		if other.database != name {
+			continue
+		}
+		if !force {
+			return fmt.Errorf("database %q is being accessed by other users", name)
+		}
+		other.terminate()
+	}
+	delete(c.server.databases, name)
+	for key := range c.server.settings {
+		if key.database == name {
+			delete(c.server.settings, key)
+		}
+	}
+	return nil
+}
+
+func (c *conn) createSchema(p *parser) error {
+	name, err := p.identifier()
+	if err != nil {
+		return err
+	}
+	owner := c.user
+	if p.accept("AUTHORIZATION") {
+		owner, err = p.identifier()
+		if err != nil {
+			return err
+		}
+		_, err = c.role(owner)
+		if err != nil {
+			return err
+		}
+	}
+	d := c.server.databases[c.database]
+	if _, ok := d.schemas[name]; ok {
+		return fmt.Errorf("schema %q already exists", name)
+	}
+	d.schemas[name] = newSchema(owner)
+	return nil
+}
+
+func (c *conn) alterSchema(p *parser) error {
+	name, err := p.identifier()
+	if err != nil {
+		return err
+	}
+	sch, err := c.schema(name)
+	if err != nil {
+		return err
+	}
+	err = p.expect("OWNER", "TO")
+	if err != nil {
+		return err
+	}
+	owner, err := p.identifier()
+	if err != nil {
+		return err
+	}
+	_, err = c.role(owner)
+	if err != nil {
+		return err
+	}
+	sch.owner = owner
+	return nil
+}
+
+func (c *conn) createExtension(p *parser) error {
+	ifNotExists := p.accept("IF", "NOT", "EXISTS")
+	name, err := p.identifier()
+	if err != nil {
+		return err
+	}
+	versions, ok := c.server.available[name]
+	if !ok {
+		return fmt.Errorf("extension %q is not available", name)
+	}
+	extension := &provisioner.Extension{
+		Name:    name,
+		Schema:  "public",
+		Version: versions[0],
+	}
+	for !p.done() {
+		switch {
+		case p.accept("SCHEMA"):
+			extension.Schema, err = p.identifier()
+			if (err == nil) && (c.currentSchema(extension.Schema) == nil) {
+				err = fmt.Errorf("schema %q does not exist", extension.Schema)
+			}
+		case p.accept("VERSION"):
+			extension.Version, err = p.literal()
+		default:
+			err = p.syntaxError()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	d := c.server.databases[c.database]
+	if _, ok := d.extensions[name]; ok {
+		if ifNotExists {
+			return nil
+		}
+		return fmt.Errorf("extension %q already exists", name)
+	}
+	d.extensions[name] = extension
+	return nil
+}
+
+func (c *conn) alterExtension(p *parser) error {
+	name, err := p.identifier()
+	if err != nil {
+		return err
+	}
+	extension, ok := c.server.databases[c.database].extensions[name]
+	if !ok {
+		return fmt.Errorf("extension %q does not exist", name)
+	}
+	if p.accept("UPDATE", "TO") {
+		extension.Version, err = p.literal()
+		return err
+	}
+	err = p.expect("SET", "SCHEMA")
+	if err != nil {
+		return err
+	}
+	schemaName, err := p.identifier()
+	if err != nil {
+		return err
+	}
+	_, err = c.schema(schemaName)
+	if err != nil {
+		return err
+	}
+	extension.Schema = schemaName
+	return nil
+}
+
+// objectType parses the object type of privileges on relations.
+func objectType(p *parser) (string, error) {
+	if p.accept(provisioner.ObjectTables) {
+		return provisioner.ObjectTables, nil
+	}
+	if p.accept(provisioner.ObjectSequences) {
+		return provisioner.ObjectSequences, nil
+	}
+	return "", p.syntaxError()
+}
+
+// grantee parses the TO or FROM clause of a GRANT or REVOKE statement.
+func (c *conn) grantee(p *parser, isGrant bool) (string, error) {
+	var err error
+	if isGrant {
+		err = p.expect("TO")
+	} else {
+		err = p.expect("FROM")
+	}
+	if err != nil {
+		return "", err
+	}
+	name, err := p.identifier()
+	if err != nil {
+		return "", err
+	}
+	_, err = c.role(name)
+	if err != nil {
+		return "", err
+	}
+	if !p.done() {
+		return "", p.syntaxError()
+	}
+	return name, nil
+}
+
+func (c *conn) alterDefaultPrivileges(p *parser) error {
+	err := p.expect("FOR", "ROLE")
+	if err != nil {
+		return err
+	}
+	creator, err := p.identifier()
+	if err != nil {
+		return err
+	}
+	_, err = c.role(creator)
+	if err != nil {
+		return err
+	}
+	if !c.server.hasPrivilegesOf(c.user, creator) {
+		return fmt.Errorf("permission denied to change default privileges of role %q", creator)
+	}
+	err = p.expect("IN", "SCHEMA")
+	if err != nil {
+		return err
+	}
+	schemaName, err := p.identifier()
+	if err != nil {
+		return err
+	}
+	sch, err := c.schema(schemaName)
+	if err != nil {
+		return err
+	}
+	isGrant := p.accept("GRANT")
+	if !isGrant {
+		err = p.expect("REVOKE")
+		if err != nil {
+			return err
+		}
+	}
+	privileges, err := p.keywordList()
+	if err != nil {
+		return err
+	}
+	err = p.expect("ON")
+	if err != nil {
+		return err
+	}
+	objType, err := objectType(p)
+	if err != nil {
+		return err
+	}
+	grantee, err := c.grantee(p, isGrant)
+	if err != nil {
+		return err
+	}
+	if sch.defaultPrivileges[objType] == nil {
+		sch.defaultPrivileges[objType] = make(map[string]map[string][]string)
+	}
+	if sch.defaultPrivileges[objType][creator] == nil {
+		sch.defaultPrivileges[objType][creator] = make(map[string][]string)
+	}
+	if isGrant {
+		grant(sch.defaultPrivileges[objType][creator], grantee, privileges)
+	} else {
+		revoke(sch.defaultPrivileges[objType][creator], grantee, privileges)
+	}
+	return nil
+}
+
+// grantOrRevoke executes GRANT and REVOKE statements on schemas, on all
+// relations in a schema, and of role memberships.
+func (c *conn) grantOrRevoke(p *parser, isGrant bool) error {
+	if !isGrant && p.accept("ADMIN", "OPTION", "FOR") {
+		return c.revokeMembership(p, true)
+	}
+	start := p.pos
+	privileges, err := p.keywordList()
+	if (err != nil) || !p.accept("ON") {
+		p.pos = start
+		if isGrant {
+			return c.grantMembership(p)
+		}
+		return c.revokeMembership(p, false)
+	}
+
+	var grants map[string][]string
+	if p.accept("SCHEMA") {
+		schemaName, err := p.identifier()
+		if err != nil {
+			return err
+		}
+		sch, err := c.schema(schemaName)
+		if err != nil {
+			return err
+		}
+		grants = sch.privileges
+	} else {
+		err = p.expect("ALL")
+		if err != nil {
+			return err
+		}
+		objType, err := objectType(p)
+		if err != nil {
+			return err
+		}
+		err = p.expect("IN", "SCHEMA")
+		if err != nil {
+			return err
+		}
+		schemaName, err := p.identifier()
+		if err != nil {
+			return err
+		}
+		sch, err := c.schema(schemaName)
+		if err != nil {
+			return err
+		}
+		if sch.relationPrivileges[objType] == nil {
+			sch.relationPrivileges[objType] = make(map[string][]string)
+		}
+		grants = sch.relationPrivileges[objType]
+	}
+	grantee, err := c.grantee(p, isGrant)
+	if err != nil {
+		return err
+	}
+	if isGrant {
+		grant(grants, grantee, privileges)
+	} else {
+		revoke(grants, grantee, privileges)
+	}
+	return nil
+}
+
+func (c *conn) grantMembership(p *parser) error {
+	group, err := p.identifier()
+	if err != nil {
+		return err
+	}
+	_, err = c.role(group)
+	if err != nil {
+		return err
+	}
+	err = c.canManageRole(group)
+	if err != nil {
+		return err
+	}
+	err = p.expect("TO")
+	if err != nil {
+		return err
+	}
+	member, err := p.identifier()
+	if err != nil {
+		return err
+	}
+	memberRole, err := c.role(member)
+	if err != nil {
+		return err
+	}
+
+	if c.server.memberships[group] == nil {
+		c.server.memberships[group] = make(map[string]*provisioner.Membership)
+	}
+	membership, ok := c.server.memberships[group][member]
+	if !ok {
+		membership = &provisioner.Membership{
+			Member: member,
+		}
+		if c.server.version >= 160000 {
+			inherit := memberRole.Inherit
+			set := true
+			membership.Inherit = &inherit
+			membership.Set = &set
+		}
+	}
+	updated := *membership
+	if p.accept("WITH") {
+		for {
+			switch {
+			case p.accept("ADMIN", "OPTION"):
+				updated.Admin = true
+			case p.accept("ADMIN"):
+				updated.Admin, err = p.boolean()
+			case (c.server.version >= 160000) && p.accept("INHERIT"):
+				var inherit bool
+				inherit, err = p.boolean()
+				updated.Inherit = &inherit
+			case (c.server.version >= 160000) && p.accept("SET"):
+				var set bool
+				set, err = p.boolean()
+				updated.Set = &set
+			default:
+				err = p.syntaxError()
+			}
+			if err != nil {
+				return err
+			}
+			if !p.accept(",") {
+				break
+			}
+		}
+	}
+	if !p.done() {
+		return p.syntaxError()
+	}
+	c.server.memberships[group][member] = &updated
+	return nil
+}
+
+func (c *conn) revokeMembership(p *parser, adminOption bool) error {
+	group, err := p.identifier()
+	if err != nil {
+		return err
+	}
+	_, err = c.role(group)
+	if err != nil {
+		return err
+	}
+	err = c.canManageRole(group)
+	if err != nil {
+		return err
+	}
+	member, err := c.grantee(p, false)
+	if err != nil {
+		return err
+	}
+	membership, ok := c.server.memberships[group][member]
+	if !ok {
+		return nil
+	}
+	if adminOption {
+		membership.Admin = false
+		return nil
+	}
+	delete(c.server.memberships[group], member)
+	if len(c.server.memberships[group]) == 0 {
+		delete(c.server.memberships, group)
+	}
+	return nil
+}
+
+// reassignOwned reassigns the schemas in the database connected to, and the
+// databases, owned by the role.
+func (c *conn) reassignOwned(p *parser) error {
+	name, err := p.identifier()
+	if err != nil {
+		return err
+	}
+	_, err = c.role(name)
+	if err != nil {
+		return err
+	}
+	newOwner, err := c.grantee(p, true)
+	if err != nil {
+		return err
+	}
+	for _, d := range c.server.databases {
+		if d.Owner == name {
+			d.Owner = newOwner
+		}
+	}
+	for _, sch := range c.server.databases[c.database].schemas {
+		if sch.owner == name {
+			sch.owner = newOwner
+		}
+	}
+	return nil
+}
+
+// dropOwned drops the schemas owned by the role in the database connected to,
+// and revokes the privileges granted to it there.
+func (c *conn) dropOwned(p *parser) error {
+	name, err := p.identifier()
+	if err != nil {
+		return err
+	}
+	_, err = c.role(name)
+	if err != nil {
+		return err
+	}
+	if !p.done() {
+		return p.syntaxError()
+	}
+	d := c.server.databases[c.database]
+	maps.DeleteFunc(d.schemas, func(_ string, sch *schema) bool {
+		return sch.owner == name
+	})
+	for _, sch := range d.schemas {
+		delete(sch.privileges, name)
+		for _, grants := range sch.relationPrivileges {
+			delete(grants, name)
+		}
+		for _, byCreator := range sch.defaultPrivileges {
+			delete(byCreator, name)
+			for _, grants := range byCreator {
+				delete(grants, name)
+			}
+		}
+	}
+	return nil
+}
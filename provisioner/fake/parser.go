@@ -0,0 +1,245 @@
+package fake
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenQuoted
+	tokenLiteral
+	tokenNumber
+	tokenSymbol
+)
+
+type token struct {
+	kind tokenKind
+	text string
+}
+
+// tokenize splits a statement into words, quoted identifiers, string literals,
+// numbers and symbols.
+func tokenize(query string) ([]token, error) {
+	tokens := make([]token, 0)
+	runes := []rune(query)
+	for i := 0; i < len(runes); {
+		c := runes[i]
+		switch {
+		case (c == ' ') || (c == '\t') || (c == '\n') || (c == '\r'):
+			i++
+		case ((c == 'E') || (c == 'e')) && (i+1 < len(runes)) && (runes[i+1] == '\''):
+			text, next, err := readQuoted(runes, i+1, '\'', true)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokenLiteral, text: text})
+			i = next
+		case c == '\'':
+			text, next, err := readQuoted(runes, i, '\'', false)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokenLiteral, text: text})
+			i = next
+		case c == '"':
+			text, next, err := readQuoted(runes, i, '"', false)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokenQuoted, text: text})
+			i = next
+		case ((c >= '0') && (c <= '9')) || ((c == '-') && (i+1 < len(runes)) && (runes[i+1] >= '0') && (runes[i+1] <= '9')):
+			start := i
+			i++
+			for (i < len(runes)) && (runes[i] >= '0') && (runes[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: string(runes[start:i])})
+		case isWordRune(c, true):
+			start := i
+			for (i < len(runes)) && isWordRune(runes[i], false) {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokenWord, text: string(runes[start:i])})
+		case strings.ContainsRune(",=().;", c):
+			tokens = append(tokens, token{kind: tokenSymbol, text: string(c)})
+			i++
+		default:
+			return nil, fmt.Errorf("syntax error at or near %q", string(c))
+		}
+	}
+	return tokens, nil
+}
+
+func isWordRune(c rune, first bool) bool {
+	if ((c >= 'a') && (c <= 'z')) || ((c >= 'A') && (c <= 'Z')) || (c == '_') || (c > 127) {
+		return true
+	}
+	return !first && (((c >= '0') && (c <= '9')) || (c == '$'))
+}
+
+// readQuoted reads a quoted string starting at the opening quote, in which a
+// doubled quote stands for itself. In escape strings, a backslash escapes the
+// next character.
+func readQuoted(runes []rune, start int, quote rune, escapes bool) (string, int, error) {
+	var sb strings.Builder
+	for i := start + 1; i < len(runes); i++ {
+		c := runes[i]
+		if escapes && (c == '\\') && (i+1 < len(runes)) {
+			i++
+			sb.WriteRune(runes[i])
+			continue
+		}
+		if c == quote {
+			if (i+1 < len(runes)) && (runes[i+1] == quote) {
+				sb.WriteRune(quote)
+				i++
+				continue
+			}
+			return sb.String(), i + 1, nil
+		}
+		sb.WriteRune(c)
+	}
+	return "", 0, fmt.Errorf("unterminated quoted string")
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek(offset int) *token {
+	if p.pos+offset >= len(p.tokens) {
+		return nil
+	}
+	return &p.tokens[p.pos+offset]
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+// accept consumes the keywords if the next tokens match them.
+func (p *parser) accept(keywords ...string) bool {
+	for i, keyword := range keywords {
+		t := p.peek(i)
+		if (t == nil) || ((t.kind != tokenWord) && (t.kind != tokenSymbol)) || !strings.EqualFold(t.text, keyword) {
+			return false
+		}
+	}
+	p.pos += len(keywords)
+	return true
+}
+
+func (p *parser) expect(keywords ...string) error {
+	if !p.accept(keywords...) {
+		return p.syntaxError()
+	}
+	return nil
+}
+
+func (p *parser) syntaxError() error {
+	t := p.peek(0)
+	if t == nil {
+		return fmt.Errorf("syntax error at end of input")
+	}
+	return fmt.Errorf("syntax error at or near %q", t.text)
+}
+
+// identifier reads an identifier. Unquoted identifiers are folded to lower
+// case.
+func (p *parser) identifier() (string, error) {
+	t := p.peek(0)
+	if t == nil {
+		return "", p.syntaxError()
+	}
+	switch t.kind {
+	case tokenWord:
+		p.pos++
+		return strings.ToLower(t.text), nil
+	case tokenQuoted:
+		p.pos++
+		return t.text, nil
+	}
+	return "", p.syntaxError()
+}
+
+// qualifiedName reads dot-separated identifiers, such as a customized setting
+// name.
+func (p *parser) qualifiedName() (string, error) {
+	parts := make([]string, 0)
+	for {
+		part, err := p.identifier()
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, part)
+		if !p.accept(".") {
+			break
+		}
+	}
+	return strings.Join(parts, "."), nil
+}
+
+func (p *parser) literal() (string, error) {
+	t := p.peek(0)
+	if (t == nil) || (t.kind != tokenLiteral) {
+		return "", p.syntaxError()
+	}
+	p.pos++
+	return t.text, nil
+}
+
+func (p *parser) number() (int, error) {
+	t := p.peek(0)
+	if (t == nil) || (t.kind != tokenNumber) {
+		return 0, p.syntaxError()
+	}
+	p.pos++
+	return strconv.Atoi(t.text)
+}
+
+func (p *parser) boolean() (bool, error) {
+	if p.accept("TRUE") {
+		return true, nil
+	}
+	if p.accept("FALSE") {
+		return false, nil
+	}
+	return false, p.syntaxError()
+}
+
+// keywordList reads comma-separated keywords, such as privileges.
+func (p *parser) keywordList() ([]string, error) {
+	keywords := make([]string, 0)
+	for {
+		t := p.peek(0)
+		if (t == nil) || (t.kind != tokenWord) {
+			return nil, p.syntaxError()
+		}
+		p.pos++
+		keywords = append(keywords, strings.ToUpper(t.text))
+		if !p.accept(",") {
+			return keywords, nil
+		}
+	}
+}
+
+// literalList reads comma-separated string literals.
+func (p *parser) literalList() ([]string, error) {
+	literals := make([]string, 0)
+	for {
+		literal, err := p.literal()
+		if err != nil {
+			return nil, err
+		}
+		literals = append(literals, literal)
+		if !p.accept(",") {
+			return literals, nil
+		}
+	}
+}
@@ -0,0 +1,426 @@
+// Package fake provides an in-memory PostgreSQL server for testing code built
+// on the provisioner package without a real server.
+//
+// The server models roles, role memberships, databases, schemas, extensions,
+// runtime settings and privileges, and understands the statements issued by a
+// Provisioner. Every schema is modelled as containing tables and sequences,
+// so privileges on all tables or sequences in a schema are tracked as a single
+// grant.
+//
+// As on a real server, the privileges needed to manage roles, create databases
+// and alter default privileges are checked, a database with open connections
+// can only be dropped with FORCE, and a statement that fails aborts the
+// transaction in progress until it is rolled back.
+package fake
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/ngyewch/pq-provisioner/provisioner"
+)
+
+// BootstrapSuperuser is the superuser that every Server is created with.
+const BootstrapSuperuser = "postgres"
+
+type role struct {
+	provisioner.Role
+	password   string
+	validUntil string
+}
+
+type database struct {
+	provisioner.Database
+	schemas    map[string]*schema
+	extensions map[string]*provisioner.Extension
+}
+
+type schema struct {
+	owner string
+	// privileges holds the privileges on the schema, by grantee.
+	privileges map[string][]string
+	// relationPrivileges holds the privileges on all relations of an object
+	// type in the schema, by object type and grantee.
+	relationPrivileges map[string]map[string][]string
+	// defaultPrivileges holds the default privileges in the schema, by object
+	// type, creator and grantee.
+	defaultPrivileges map[string]map[string]map[string][]string
+}
+
+type settingsKey struct {
+	database string
+	role     string
+}
+
+// advisoryLockKey identifies an advisory lock, which is scoped to a database.
+type advisoryLockKey struct {
+	database string
+	key      int64
+}
+
+// state is the part of a Server that transactions roll back.
+type state struct {
+	roles       map[string]*role
+	databases   map[string]*database
+	memberships map[string]map[string]*provisioner.Membership
+	settings    map[settingsKey]map[string]string
+	statements  []string
+}
+
+// Server is an in-memory PostgreSQL server. It is safe for concurrent use.
+//
+// Transactions are not isolated: statements take effect as they are executed,
+// and rolling back a transaction restores the whole server to its state when
+// the transaction began.
+type Server struct {
+	state
+	mu         sync.Mutex
+	version    int
+	available  map[string][]string
+	inRecovery bool
+	// advisoryLocks holds the connection holding each advisory lock.
+	advisoryLocks map[advisoryLockKey]*conn
+	// conns holds the open connections.
+	conns map[*conn]bool
+}
+
+// NewServer returns a server reporting the specified version number, such as
+// 160004. It has the bootstrap superuser, some predefined roles, and the
+// postgres, template0 and template1 databases.
+func NewServer(version int) *Server {
+	s := &Server{
+		state: state{
+			roles:       make(map[string]*role),
+			databases:   make(map[string]*database),
+			memberships: make(map[string]map[string]*provisioner.Membership),
+			settings:    make(map[settingsKey]map[string]string),
+		},
+		version:       version,
+		advisoryLocks: make(map[advisoryLockKey]*conn),
+		conns:         make(map[*conn]bool),
+		available: map[string][]string{
+			"plpgsql": {"1.0"},
+		},
+	}
+	s.roles[BootstrapSuperuser] = &role{
+		Role: provisioner.Role{
+			Login:           true,
+			Superuser:       true,
+			CreateDB:        true,
+			CreateRole:      true,
+			Inherit:         true,
+			Replication:     true,
+			BypassRLS:       true,
+			ConnectionLimit: -1,
+			System:          true,
+		},
+	}
+	for _, name := range []string{"pg_database_owner", "pg_read_all_data", "pg_write_all_data", "pg_monitor"} {
+		s.roles[name] = &role{
+			Role: provisioner.Role{
+				Inherit:         true,
+				ConnectionLimit: -1,
+				System:          true,
+			},
+		}
+	}
+	for _, name := range []string{"postgres", "template0", "template1"} {
+		d := s.newDatabase(BootstrapSuperuser)
+		d.IsTemplate = name != "postgres"
+		d.AllowConnections = name != "template0"
+		s.databases[name] = d
+	}
+	return s
+}
+
+func (s *Server) newDatabase(owner string) *database {
+	publicOwner := BootstrapSuperuser
+	if s.version >= 150000 {
+		publicOwner = "pg_database_owner"
+	}
+	return &database{
+		Database: provisioner.Database{
+			Owner:            owner,
+			Encoding:         "UTF8",
+			LcCollate:        "en_US.utf8",
+			LcCtype:          "en_US.utf8",
+			LocaleProvider:   "libc",
+			Tablespace:       "pg_default",
+			ConnectionLimit:  -1,
+			AllowConnections: true,
+		},
+		schemas: map[string]*schema{
+			"public": newSchema(publicOwner),
+		},
+		extensions: map[string]*provisioner.Extension{
+			"plpgsql": {Name: "plpgsql", Schema: "pg_catalog", Version: "1.0"},
+		},
+	}
+}
+
+func newSchema(owner string) *schema {
+	return &schema{
+		owner:              owner,
+		privileges:         make(map[string][]string),
+		relationPrivileges: make(map[string]map[string][]string),
+		defaultPrivileges:  make(map[string]map[string]map[string][]string),
+	}
+}
+
+// AddExtension makes the versions of an extension available for installation.
+// The first version is the default.
+func (s *Server) AddExtension(name string, versions ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.available[name] = versions
+}
+
+// Connect opens a connection to the named database as the user. An empty
+// databaseName defaults to the user name, as with libpq. Its signature matches
+// provisioner.Connector.
+func (s *Server) Connect(ctx context.Context, databaseName string, user string) (provisioner.Conn, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if databaseName == "" {
+		databaseName = user
+	}
+	r, ok := s.roles[user]
+	if !ok {
+		return nil, fmt.Errorf("role %q does not exist", user)
+	}
+	if !r.Login {
+		return nil, fmt.Errorf("role %q is not permitted to log in", user)
+	}
+	d, ok := s.databases[databaseName]
+	if !ok {
+		return nil, fmt.Errorf("database %q does not exist", databaseName)
+	}
+	if !d.AllowConnections {
+		return nil, fmt.Errorf("database %q is not currently accepting connections", databaseName)
+	}
+	c := &conn{
+		server:   s,
+		database: databaseName,
+		user:     user,
+	}
+	s.conns[c] = true
+	return c, nil
+}
+
+// SetInRecovery puts the server in or out of recovery. While in recovery, the
+// server rejects statements other than SELECT, like a standby.
+func (s *Server) SetInRecovery(inRecovery bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.inRecovery = inRecovery
+}
+
+// Statements returns the statements executed so far, in order. Statements of
+// rolled back transactions are not included.
+func (s *Server) Statements() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.statements)
+}
+
+// clone returns a deep copy of the state.
+func (st *state) clone() *state {
+	cloned := &state{
+		roles:       make(map[string]*role, len(st.roles)),
+		databases:   make(map[string]*database, len(st.databases)),
+		memberships: make(map[string]map[string]*provisioner.Membership, len(st.memberships)),
+		settings:    make(map[settingsKey]map[string]string, len(st.settings)),
+		statements:  slices.Clone(st.statements),
+	}
+	for name, r := range st.roles {
+		copied := *r
+		cloned.roles[name] = &copied
+	}
+	for name, d := range st.databases {
+		cloned.databases[name] = d.clone()
+	}
+	for group, members := range st.memberships {
+		cloned.memberships[group] = make(map[string]*provisioner.Membership, len(members))
+		for member, membership := range members {
+			copied := *membership
+			cloned.memberships[group][member] = &copied
+		}
+	}
+	for key, settings := range st.settings {
+		cloned.settings[key] = maps.Clone(settings)
+	}
+	return cloned
+}
+
+func (d *database) clone() *database {
+	cloned := &database{
+		Database:   d.Database,
+		schemas:    make(map[string]*schema, len(d.schemas)),
+		extensions: make(map[string]*provisioner.Extension, len(d.extensions)),
+	}
+	for name, sch := range d.schemas {
+		cloned.schemas[name] = sch.clone()
+	}
+	for name, extension := range d.extensions {
+		copied := *extension
+		cloned.extensions[name] = &copied
+	}
+	return cloned
+}
+
+func (sch *schema) clone() *schema {
+	cloned := newSchema(sch.owner)
+	cloneGrants(cloned.privileges, sch.privileges)
+	for objectType, grants := range sch.relationPrivileges {
+		cloned.relationPrivileges[objectType] = make(map[string][]string, len(grants))
+		cloneGrants(cloned.relationPrivileges[objectType], grants)
+	}
+	for objectType, byCreator := range sch.defaultPrivileges {
+		cloned.defaultPrivileges[objectType] = make(map[string]map[string][]string, len(byCreator))
+		for creator, grants := range byCreator {
+			cloned.defaultPrivileges[objectType][creator] = make(map[string][]string, len(grants))
+			cloneGrants(cloned.defaultPrivileges[objectType][creator], grants)
+		}
+	}
+	return cloned
+}
+
+// cloneGrants copies the privileges of each grantee into dst.
+func cloneGrants(dst map[string][]string, src map[string][]string) {
+	for grantee, privileges := range src {
+		dst[grantee] = slices.Clone(privileges)
+	}
+}
+
+// setPassword stores the password the way the server would: verifiers are
+// stored as given, and plain passwords are stored as MD5 verifiers.
+func (r *role) setPassword(name string, password string) {
+	if strings.HasPrefix(password, "SCRAM-SHA-256$") || (strings.HasPrefix(password, "md5") && (len(password) == 35)) {
+		r.password = password
+		return
+	}
+	sum := md5.Sum([]byte(password + name))
+	r.password = "md5" + hex.EncodeToString(sum[:])
+}
+
+// effectiveRoles returns the role and the roles whose privileges it inherits
+// through memberships.
+func (s *Server) effectiveRoles(roleName string) []string {
+	result := []string{roleName}
+	for i := 0; i < len(result); i++ {
+		member := result[i]
+		r, ok := s.roles[member]
+		if !ok {
+			continue
+		}
+		for _, group := range slices.Sorted(maps.Keys(s.memberships)) {
+			membership, ok := s.memberships[group][member]
+			if !ok || slices.Contains(result, group) {
+				continue
+			}
+			inherit := r.Inherit
+			if membership.Inherit != nil {
+				inherit = *membership.Inherit
+			}
+			if inherit {
+				result = append(result, group)
+			}
+		}
+	}
+	return result
+}
+
+// hasPrivilegesOf reports whether the role holds the privileges of the other
+// role, as a superuser, or as the role itself or a member inheriting from it.
+func (s *Server) hasPrivilegesOf(roleName string, otherName string) bool {
+	r, ok := s.roles[roleName]
+	if !ok {
+		return false
+	}
+	return r.Superuser || slices.Contains(s.effectiveRoles(roleName), otherName)
+}
+
+// hasPrivileges reports whether the role holds all the privileges, as an
+// owner, superuser, or through grants to it or to roles it inherits from.
+func (s *Server) hasPrivileges(roleName string, owner string, grants map[string][]string, privileges []string) bool {
+	r, ok := s.roles[roleName]
+	if !ok {
+		return false
+	}
+	if r.Superuser {
+		return true
+	}
+	roles := s.effectiveRoles(roleName)
+	if slices.Contains(roles, owner) {
+		return true
+	}
+	for _, privilege := range privileges {
+		if !slices.ContainsFunc(roles, func(name string) bool {
+			return slices.Contains(grants[name], privilege)
+		}) {
+			return false
+		}
+	}
+	return true
+}
+
+// ownsObjects reports whether the role owns a database or a schema, or holds
+// privileges in any database.
+func (s *Server) ownsObjects(roleName string) bool {
+	for _, d := range s.databases {
+		if d.Owner == roleName {
+			return true
+		}
+		for _, sch := range d.schemas {
+			if (sch.owner == roleName) || (len(sch.privileges[roleName]) > 0) {
+				return true
+			}
+			for _, grants := range sch.relationPrivileges {
+				if len(grants[roleName]) > 0 {
+					return true
+				}
+			}
+			for _, creators := range sch.defaultPrivileges {
+				if len(creators[roleName]) > 0 {
+					return true
+				}
+				for _, grants := range creators {
+					if len(grants[roleName]) > 0 {
+						return true
+					}
+				}
+			}
+		}
+	}
+	return false
+}
+
+// grant adds privileges to a grantee's privileges.
+func grant(grants map[string][]string, grantee string, privileges []string) {
+	for _, privilege := range privileges {
+		if !slices.Contains(grants[grantee], privilege) {
+			grants[grantee] = append(grants[grantee], privilege)
+		}
+	}
+	slices.Sort(grants[grantee])
+}
+
+// revoke removes privileges from a grantee's privileges.
+func revoke(grants map[string][]string, grantee string, privileges []string) {
+	grants[grantee] = slices.DeleteFunc(grants[grantee], func(privilege string) bool {
+		return slices.Contains(privileges, privilege)
+	})
+	if len(grants[grantee]) == 0 {
+		delete(grants, grantee)
+	}
+}
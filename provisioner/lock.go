@@ -0,0 +1,119 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// DefaultLockKey is the advisory lock key used when the config does not
+// specify one.
+const DefaultLockKey int64 = 0x707170726f76
+
+// DefaultLockTimeout is how long to wait for the advisory lock when the config
+// does not specify a timeout.
+const DefaultLockTimeout = 5 * time.Minute
+
+// lockRetryDelay is the delay between attempts to take the advisory lock.
+const lockRetryDelay = time.Second
+
+// ErrLocked is returned by ConfigProvisioner.Provision when another run holds
+// the advisory lock for longer than the lock timeout.
+var ErrLocked = errors.New("another run holds the provisioning lock")
+
+// lockKey returns the advisory lock key of the config.
+func (p *ConfigProvisioner) lockKey() int64 {
+	if p.cfg.Lock.Key == 0 {
+		return DefaultLockKey
+	}
+	return p.cfg.Lock.Key
+}
+
+// lockTimeout returns how long to wait for the advisory lock. It is negative
+// to fail at once.
+func (p *ConfigProvisioner) lockTimeout() time.Duration {
+	if p.cfg.Lock.Timeout == 0 {
+		return DefaultLockTimeout
+	}
+	return p.cfg.Lock.Timeout
+}
+
+// takeLock takes the advisory lock in the lock database, on the admin
+// connection if the lock database is not configured or is the admin database,
+// and on a connection of its own otherwise. It returns a function that
+// releases the lock.
+func (p *ConfigProvisioner) takeLock(ctx context.Context, conn Conn) (func(), error) {
+	currentDatabase, err := conn.CurrentDatabase(ctx)
+	if err != nil {
+		return nil, err
+	}
+	lockConn := conn
+	if (p.cfg.Lock.Database != "") && (p.cfg.Lock.Database != currentDatabase) {
+		lockConn, err = p.openDB(ctx, p.cfg.Lock.Database, p.cfg.User)
+		if err != nil {
+			return nil, err
+		}
+	}
+	closeLockConn := func() {
+		if lockConn != conn {
+			_ = lockConn.Close()
+		}
+	}
+
+	err = p.acquireLock(ctx, lockConn)
+	if err != nil {
+		closeLockConn()
+		return nil, err
+	}
+	return func() {
+		p.releaseLock(ctx, lockConn)
+		closeLockConn()
+	}, nil
+}
+
+// acquireLock takes the advisory lock on the connection, retrying until the
+// lock timeout elapses.
+func (p *ConfigProvisioner) acquireLock(ctx context.Context, conn Conn) error {
+	key := p.lockKey()
+	timeout := p.lockTimeout()
+	deadline := time.Now().Add(timeout)
+	for attempt := 1; ; attempt++ {
+		locked, err := conn.TryAdvisoryLock(ctx, key)
+		if err != nil {
+			return fmt.Errorf("failed to take provisioning lock: %w", err)
+		}
+		if locked {
+			return nil
+		}
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("%w (key %d, waited %s)", ErrLocked, key, max(timeout, 0))
+		}
+		if attempt == 1 {
+			log.LogAttrs(ctx, slog.LevelInfo, "Waiting for provisioning lock",
+				slog.Int64("key", key),
+				slog.Duration("timeout", timeout),
+			)
+		}
+
+		timer := time.NewTimer(min(lockRetryDelay, remaining))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return context.Cause(ctx)
+		case <-timer.C:
+		}
+	}
+}
+
+// releaseLock releases the advisory lock, even if the context is done.
+func (p *ConfigProvisioner) releaseLock(ctx context.Context, conn Conn) {
+	err := conn.AdvisoryUnlock(context.WithoutCancel(ctx), p.lockKey())
+	if err != nil {
+		log.LogAttrs(ctx, slog.LevelWarn, "Failed to release provisioning lock",
+			slog.String("error", err.Error()),
+		)
+	}
+}
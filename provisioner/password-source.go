@@ -0,0 +1,132 @@
+package provisioner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/ngyewch/pq-provisioner/config"
+)
+
+// Names of the builtin password providers.
+const (
+	PasswordProviderFile    = "file"
+	PasswordProviderEnv     = "env"
+	PasswordProviderCommand = "command"
+)
+
+// PasswordProvider reads passwords from an external source, such as a secret
+// manager. Providers are registered by name with RegisterPasswordProvider, and
+// referenced from the config as passwordFrom = "name:ref". Errors must not
+// contain the password.
+type PasswordProvider interface {
+	// Password returns the password identified by ref.
+	Password(ctx context.Context, ref string) (string, error)
+}
+
+// PasswordProviderFunc adapts a function to a PasswordProvider.
+type PasswordProviderFunc func(ctx context.Context, ref string) (string, error)
+
+func (f PasswordProviderFunc) Password(ctx context.Context, ref string) (string, error) {
+	return f(ctx, ref)
+}
+
+var passwordProviders = struct {
+	sync.RWMutex
+	m map[string]PasswordProvider
+}{
+	m: map[string]PasswordProvider{
+		PasswordProviderFile:    PasswordProviderFunc(readPasswordFile),
+		PasswordProviderEnv:     PasswordProviderFunc(readPasswordEnv),
+		PasswordProviderCommand: PasswordProviderFunc(readPasswordCommand),
+	},
+}
+
+// RegisterPasswordProvider registers a password provider under the name,
+// replacing any provider registered under the same name.
+func RegisterPasswordProvider(name string, provider PasswordProvider) {
+	passwordProviders.Lock()
+	defer passwordProviders.Unlock()
+	passwordProviders.m[name] = provider
+}
+
+func getPasswordProvider(name string) (PasswordProvider, bool) {
+	passwordProviders.RLock()
+	defer passwordProviders.RUnlock()
+	provider, ok := passwordProviders.m[name]
+	return provider, ok
+}
+
+// ResolvePassword returns the password of the user, reading it from its
+// source if the config does not specify it directly. It returns an empty
+// string if the user has no password.
+func ResolvePassword(ctx context.Context, user *config.User) (string, error) {
+	var providerName, ref string
+	switch {
+	case user.PasswordFile != "":
+		providerName, ref = PasswordProviderFile, user.PasswordFile
+	case user.PasswordEnv != "":
+		providerName, ref = PasswordProviderEnv, user.PasswordEnv
+	case user.PasswordCommand != "":
+		providerName, ref = PasswordProviderCommand, user.PasswordCommand
+	case user.PasswordFrom != "":
+		var ok bool
+		providerName, ref, ok = strings.Cut(user.PasswordFrom, ":")
+		if !ok {
+			return "", fmt.Errorf("password source of user %s must be of the form name:ref", user.Name)
+		}
+	default:
+		return user.Password, nil
+	}
+
+	provider, ok := getPasswordProvider(providerName)
+	if !ok {
+		return "", fmt.Errorf("password provider %s of user %s is not registered", providerName, user.Name)
+	}
+	password, err := provider.Password(ctx, ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to read password of user %s from %s: %w", user.Name, providerName, err)
+	}
+	if (user.TrimPassword == nil) || *user.TrimPassword {
+		password = strings.TrimSpace(password)
+	}
+	if password == "" {
+		return "", fmt.Errorf("password of user %s read from %s is empty", user.Name, providerName)
+	}
+	return password, nil
+}
+
+func readPasswordFile(ctx context.Context, path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func readPasswordEnv(ctx context.Context, name string) (string, error) {
+	password, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return password, nil
+}
+
+// readPasswordCommand runs the command with sh and returns its output. The
+// output of the command is never included in errors; its standard error is
+// passed through.
+func readPasswordCommand(ctx context.Context, command string) (string, error) {
+	var stdout bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		return "", err
+	}
+	return stdout.String(), nil
+}
@@ -0,0 +1,204 @@
+package provisioner
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// scramIterations is the iteration count of computed SCRAM-SHA-256
+	// verifiers, the default of scram_iterations.
+	scramIterations = 4096
+	// scramSaltLength is the salt length of computed SCRAM-SHA-256 verifiers,
+	// as used by PostgreSQL.
+	scramSaltLength = 16
+)
+
+// SetAllowMD5Passwords allows MD5 password verifiers, which are refused by
+// default. They are only computed for servers older than PostgreSQL 10, which
+// do not support SCRAM-SHA-256.
+func (p *Provisioner) SetAllowMD5Passwords(allow bool) {
+	p.allowMD5Passwords = allow
+}
+
+// SetPassword sets the password of an existing role. The password may be a
+// SCRAM-SHA-256 verifier, which is sent as is. Otherwise a verifier is
+// computed, so that the password is never sent in cleartext.
+func (p *Provisioner) SetPassword(ctx context.Context, name string, password string) error {
+	verifier, err := p.passwordVerifier(name, password)
+	if err != nil {
+		return err
+	}
+	return p.setPasswordVerifier(ctx, name, verifier, password)
+}
+
+// setPasswordVerifier sets the password verifier of an existing role. The
+// password and verifier are redacted from the recorded statement.
+func (p *Provisioner) setPasswordVerifier(ctx context.Context, name string, verifier string, password string) error {
+	return p.exec(ctx, p.conn, "", Action{ObjectType: ObjectTypeRole, Object: name, Action: ActionAltered},
+		fmt.Sprintf("ALTER ROLE %s WITH PASSWORD %s", quoteIdentifier(name), quoteLiteral(verifier)), password, verifier)
+}
+
+// passwordVerifier returns the verifier to store for the password of the
+// role: the password itself if it is a verifier, or a computed SCRAM-SHA-256
+// verifier, or an MD5 verifier if the server does not support SCRAM-SHA-256
+// and MD5 passwords are allowed.
+func (p *Provisioner) passwordVerifier(name string, password string) (string, error) {
+	if isSCRAMVerifier(password) {
+		if p.serverVersion < 100000 {
+			return "", fmt.Errorf("password of role %s is a SCRAM-SHA-256 verifier, which requires PostgreSQL 10 or later", name)
+		}
+		return password, nil
+	}
+	if isMD5Verifier(password) {
+		if !p.allowMD5Passwords {
+			return "", fmt.Errorf("password of role %s is an MD5 verifier, and MD5 passwords are not allowed", name)
+		}
+		return password, nil
+	}
+	if p.serverVersion >= 100000 {
+		return SCRAMVerifier(password)
+	}
+	if !p.allowMD5Passwords {
+		return "", fmt.Errorf("server does not support SCRAM-SHA-256 passwords, and MD5 passwords are not allowed")
+	}
+	return md5Verifier(name, password), nil
+}
+
+// PasswordMatches reports whether the password verifier stored for the role in
+// pg_authid matches the password, which may itself be a verifier. known is
+// false if the verifiers cannot be read, which usually requires superuser
+// privileges; this is checked once, so that a failed read does not abort the
+// transaction in progress. A stored MD5 verifier never matches unless MD5
+// passwords are allowed, so that it is replaced when passwords are reconciled.
+func (p *Provisioner) PasswordMatches(ctx context.Context, name string, password string) (matches bool, known bool, err error) {
+	if p.canReadPasswords == nil {
+		canReadPasswords, err := p.conn.CanReadPasswordVerifiers(ctx)
+		if err != nil {
+			return false, false, err
+		}
+		p.canReadPasswords = &canReadPasswords
+	}
+	if !*p.canReadPasswords {
+		return false, false, nil
+	}
+	verifier, err := p.conn.PasswordVerifier(ctx, name)
+	if err != nil {
+		return false, false, err
+	}
+	if verifier == "" {
+		return false, true, nil
+	}
+	if isMD5Verifier(verifier) && !p.allowMD5Passwords {
+		return false, true, nil
+	}
+	if isSCRAMVerifier(password) || isMD5Verifier(password) {
+		return subtle.ConstantTimeCompare([]byte(verifier), []byte(password)) == 1, true, nil
+	}
+	return verifyPassword(verifier, name, password), true, nil
+}
+
+// SCRAMVerifier computes a SCRAM-SHA-256 verifier of the password with a
+// random salt, in the format stored in pg_authid. As with verifyPassword, the
+// password is not normalized with SASLprep, so non-ASCII passwords should be
+// given in NFKC form.
+func SCRAMVerifier(password string) (string, error) {
+	salt := make([]byte, scramSaltLength)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+	storedKey, serverKey, err := scramKeys(password, salt, scramIterations)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("SCRAM-SHA-256$%d:%s$%s:%s", scramIterations, base64.StdEncoding.EncodeToString(salt),
+		base64.StdEncoding.EncodeToString(storedKey), base64.StdEncoding.EncodeToString(serverKey)), nil
+}
+
+// isSCRAMVerifier reports whether the password is a SCRAM-SHA-256 verifier,
+// which PostgreSQL stores as given.
+func isSCRAMVerifier(password string) bool {
+	return strings.HasPrefix(password, "SCRAM-SHA-256$")
+}
+
+// isMD5Verifier reports whether the password is an MD5 verifier, which
+// PostgreSQL stores as given.
+func isMD5Verifier(password string) bool {
+	if (len(password) != 35) || !strings.HasPrefix(password, "md5") {
+		return false
+	}
+	_, err := hex.DecodeString(password[3:])
+	return err == nil
+}
+
+// md5Verifier computes the MD5 verifier of the password of the role.
+func md5Verifier(name string, password string) string {
+	sum := md5.Sum([]byte(password + name))
+	return "md5" + hex.EncodeToString(sum[:])
+}
+
+// verifyPassword reports whether a SCRAM-SHA-256 or MD5 password verifier, as
+// stored in pg_authid, matches the password.
+func verifyPassword(verifier string, name string, password string) bool {
+	if strings.HasPrefix(verifier, "md5") {
+		expected := md5Verifier(name, password)
+		return subtle.ConstantTimeCompare([]byte(verifier), []byte(expected)) == 1
+	}
+
+	// SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>
+	mechanism, rest, ok := strings.Cut(verifier, "$")
+	if !ok || (mechanism != "SCRAM-SHA-256") {
+		return false
+	}
+	parameters, keys, ok := strings.Cut(rest, "$")
+	if !ok {
+		return false
+	}
+	iterationsString, saltString, ok := strings.Cut(parameters, ":")
+	if !ok {
+		return false
+	}
+	iterations, err := strconv.Atoi(iterationsString)
+	if err != nil {
+		return false
+	}
+	salt, err := base64.StdEncoding.DecodeString(saltString)
+	if err != nil {
+		return false
+	}
+	storedKey, serverKey, err := scramKeys(password, salt, iterations)
+	if err != nil {
+		return false
+	}
+	expected := base64.StdEncoding.EncodeToString(storedKey) + ":" + base64.StdEncoding.EncodeToString(serverKey)
+	return subtle.ConstantTimeCompare([]byte(keys), []byte(expected)) == 1
+}
+
+// scramKeys computes the SCRAM-SHA-256 StoredKey and ServerKey of a password.
+func scramKeys(password string, salt []byte, iterations int) ([]byte, []byte, error) {
+	saltedPassword, err := pbkdf2.Key(sha256.New, password, salt, iterations, sha256.Size)
+	if err != nil {
+		return nil, nil, err
+	}
+	clientKey := hmacSHA256(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	serverKey := hmacSHA256(saltedPassword, "Server Key")
+	return storedKey[:], serverKey, nil
+}
+
+func hmacSHA256(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
@@ -1,170 +1,894 @@
 package provisioner
 
 import (
-	"database/sql"
+	"context"
 	"fmt"
+	"slices"
 	"strings"
+	"time"
 
 	_ "github.com/lib/pq"
 )
 
+// Statement is an SQL statement issued by a Provisioner, with passwords
+// redacted. Database is empty for statements issued on the admin connection.
+// Transaction is the number of the transaction the statement belongs to, or 0
+// if it runs on its own.
+type Statement struct {
+	Database    string
+	SQL         string
+	Transaction int
+}
+
+// RoleAttributes holds the attributes of a role. Nil fields (and an empty
+// ValidUntil) are not specified, and are left at their current values.
+type RoleAttributes struct {
+	Login           *bool
+	Superuser       *bool
+	CreateDB        *bool
+	CreateRole      *bool
+	Inherit         *bool
+	Replication     *bool
+	BypassRLS       *bool
+	ConnectionLimit *int
+	ValidUntil      string
+}
+
+// Membership is the membership of a role in a group role. Inherit and Set
+// require PostgreSQL 16 or later, and are left unchanged when nil.
+type Membership struct {
+	Member  string
+	Admin   bool
+	Inherit *bool
+	Set     *bool
+}
+
+// DatabaseOptions holds the options of a database. Empty and nil fields are
+// not specified. Template, Encoding, LcCollate, LcCtype, LocaleProvider,
+// IcuLocale and Tablespace can only be applied when the database is created.
+type DatabaseOptions struct {
+	Template         string
+	Encoding         string
+	LcCollate        string
+	LcCtype          string
+	LocaleProvider   string
+	IcuLocale        string
+	Tablespace       string
+	ConnectionLimit  *int
+	IsTemplate       *bool
+	AllowConnections *bool
+}
+
+// Drift is a difference between the config and the server that cannot be
+// reconciled automatically.
+type Drift struct {
+	Object  string `json:"object"`
+	Message string `json:"message"`
+}
+
+// transaction is a transaction in progress on a connection.
+type transaction struct {
+	conn   Conn
+	number int
+}
+
+// Provisioner issues statements on a connection, and on the connections of
+// its DatabaseProvisioners. Statements are grouped in transactions: one is
+// started on a connection by the first statement executed on it, and is
+// committed when a statement is executed on another connection, when a
+// statement that cannot run in a transaction is executed, or by Commit. If a
+// statement fails, its transaction is rolled back. After a rollback, the
+// roles and databases known to the Provisioner may no longer match the
+// server.
 type Provisioner struct {
-	db            *sql.DB
-	usernames     []string
-	databaseNames []string
+	conn            Conn
+	dryRun          bool
+	serverVersion   int
+	currentDatabase string
+	actions         []Action
+	drifts          []Drift
+	roles           map[string]*Role
+	databases       map[string]*Database
+	tx              *transaction
+	transactions    int
+	// allowMD5Passwords allows MD5 password verifiers.
+	allowMD5Passwords bool
+	// canReadPasswords caches whether password verifiers can be read.
+	canReadPasswords *bool
+}
+
+func NewProvisioner(ctx context.Context, conn Conn) (*Provisioner, error) {
+	return newProvisioner(ctx, conn, false)
 }
 
-func NewProvisioner(db *sql.DB) (*Provisioner, error) {
+// NewDryRunProvisioner returns a Provisioner that only reads from the server.
+// Statements that would modify the server are recorded but not executed.
+func NewDryRunProvisioner(ctx context.Context, conn Conn) (*Provisioner, error) {
+	return newProvisioner(ctx, conn, true)
+}
+
+func newProvisioner(ctx context.Context, conn Conn, dryRun bool) (*Provisioner, error) {
 	p := &Provisioner{
-		db: db,
+		conn:    conn,
+		dryRun:  dryRun,
+		actions: make([]Action, 0),
 	}
-	usernames, err := p.getUsernames()
+	var err error
+	p.serverVersion, err = conn.ServerVersion(ctx)
 	if err != nil {
 		return nil, err
 	}
-	p.usernames = usernames
-	databaseNames, err := p.getDatabaseNames()
+	p.currentDatabase, err = conn.CurrentDatabase(ctx)
 	if err != nil {
 		return nil, err
 	}
-	p.databaseNames = databaseNames
-	return p, nil
-}
-
-func (p *Provisioner) getUsernames() ([]string, error) {
-	rows, err := p.db.Query("SELECT usename FROM pg_catalog.pg_user")
+	p.roles, err = conn.Roles(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-	usernames := make([]string, 0)
-	for {
-		if !rows.Next() {
-			break
+	p.databases, err = conn.Databases(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// DryRun reports whether the Provisioner only records statements.
+func (p *Provisioner) DryRun() bool {
+	return p.dryRun
+}
+
+// Statements returns the statements issued (or, in dry-run mode, planned) so far.
+func (p *Provisioner) Statements() []Statement {
+	statements := make([]Statement, 0)
+	for _, action := range p.actions {
+		if action.Statement == "" {
+			continue
 		}
-		var username string
-		err = rows.Scan(&username)
+		statements = append(statements, Statement{
+			Database:    action.Database,
+			SQL:         action.Statement,
+			Transaction: action.Transaction,
+		})
+	}
+	return statements
+}
+
+// Actions returns the actions taken (or, in dry-run mode, planned) so far.
+func (p *Provisioner) Actions() []Action {
+	return p.actions
+}
+
+// Drifts returns the differences found so far that could not be reconciled.
+func (p *Provisioner) Drifts() []Drift {
+	return p.drifts
+}
+
+// exec executes a statement in the transaction in progress on the connection,
+// starting one if needed, and records it as the action, replacing an earlier
+// skipped action on the object. Secrets are redacted from the recorded
+// statement. If the statement fails, the transaction is rolled back.
+func (p *Provisioner) exec(ctx context.Context, conn Conn, databaseName string, action Action, query string, secrets ...string) error {
+	if (p.tx != nil) && (p.tx.conn != conn) {
+		err := p.Commit()
 		if err != nil {
-			return nil, err
+			return err
+		}
+	}
+	if p.tx == nil {
+		if !p.dryRun {
+			err := conn.Begin(ctx)
+			if err != nil {
+				return err
+			}
+		}
+		p.transactions++
+		p.tx = &transaction{
+			conn:   conn,
+			number: p.transactions,
 		}
-		usernames = append(usernames, username)
 	}
-	return usernames, nil
+	action.Transaction = p.tx.number
+	err := p.record(ctx, conn, databaseName, action, query, secrets)
+	if err != nil {
+		rollbackErr := p.Rollback()
+		if rollbackErr != nil {
+			return fmt.Errorf("%w (rollback failed: %w)", err, rollbackErr)
+		}
+		return err
+	}
+	return nil
 }
 
-func (p *Provisioner) getDatabaseNames() ([]string, error) {
-	rows, err := p.db.Query("SELECT datname FROM pg_catalog.pg_database")
+// execAutocommit executes a statement that cannot run in a transaction block,
+// such as CREATE DATABASE, on its own, after committing the transaction in
+// progress.
+func (p *Provisioner) execAutocommit(ctx context.Context, conn Conn, databaseName string, action Action, query string) error {
+	err := p.Commit()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer rows.Close()
-	databaseNames := make([]string, 0)
-	for {
-		if !rows.Next() {
-			break
-		}
-		var databaseName string
-		err = rows.Scan(&databaseName)
-		if err != nil {
-			return nil, err
+	return p.record(ctx, conn, databaseName, action, query, nil)
+}
+
+// record executes a statement, unless in dry-run mode, and records it as the
+// action.
+func (p *Provisioner) record(ctx context.Context, conn Conn, databaseName string, action Action, query string, secrets []string) error {
+	action.Database = databaseName
+	action.Statement = redact(query, secrets)
+	p.actions = slices.DeleteFunc(p.actions, func(recorded Action) bool {
+		return (recorded.Action == ActionSkipped) && recorded.sameObject(action)
+	})
+	if p.dryRun {
+		p.actions = append(p.actions, action)
+		return nil
+	}
+	start := time.Now()
+	err := conn.Exec(ctx, query)
+	action.Duration = time.Since(start)
+	if err != nil {
+		action.Error = err.Error()
+	} else if action.Transaction == 0 {
+		action.Committed = true
+	}
+	p.actions = append(p.actions, action)
+	return err
+}
+
+// Commit commits the transaction in progress, if any.
+func (p *Provisioner) Commit() error {
+	if p.tx == nil {
+		return nil
+	}
+	tx := p.tx
+	p.tx = nil
+	if p.dryRun {
+		return nil
+	}
+	err := tx.conn.Commit()
+	if err != nil {
+		p.markTransaction(tx.number, func(action *Action) {
+			action.RolledBack = true
+		})
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	p.markTransaction(tx.number, func(action *Action) {
+		action.Committed = true
+	})
+	return nil
+}
+
+// Rollback rolls back the transaction in progress, if any.
+func (p *Provisioner) Rollback() error {
+	if p.tx == nil {
+		return nil
+	}
+	tx := p.tx
+	p.tx = nil
+	if p.dryRun {
+		return nil
+	}
+	p.markTransaction(tx.number, func(action *Action) {
+		action.RolledBack = true
+	})
+	return tx.conn.Rollback()
+}
+
+// markTransaction updates the recorded actions of a transaction.
+func (p *Provisioner) markTransaction(number int, mark func(action *Action)) {
+	for i := range p.actions {
+		if p.actions[i].Transaction == number {
+			mark(&p.actions[i])
 		}
-		databaseNames = append(databaseNames, databaseName)
 	}
-	return databaseNames, nil
+}
+
+// skip records that the object is up to date, unless an action on it has
+// already been recorded.
+func (p *Provisioner) skip(databaseName string, objectType string, object string) {
+	action := Action{
+		ObjectType: objectType,
+		Object:     object,
+		Action:     ActionSkipped,
+		Database:   databaseName,
+	}
+	if slices.ContainsFunc(p.actions, action.sameObject) {
+		return
+	}
+	p.actions = append(p.actions, action)
+}
+
+// handled reports whether an action on the object has been recorded.
+func (p *Provisioner) handled(databaseName string, objectType string, object string) bool {
+	action := Action{
+		ObjectType: objectType,
+		Object:     object,
+		Database:   databaseName,
+	}
+	return slices.ContainsFunc(p.actions, action.sameObject)
+}
+
+// created reports whether the object has been created in this run.
+func (p *Provisioner) created(databaseName string, objectType string, object string) bool {
+	return slices.ContainsFunc(p.actions, func(action Action) bool {
+		return (action.Action == ActionCreated) && action.sameObject(Action{
+			ObjectType: objectType,
+			Object:     object,
+			Database:   databaseName,
+		})
+	})
 }
 
 func (p *Provisioner) HasDatabase(name string) bool {
-	return stringArrayContains(p.databaseNames, name)
+	_, ok := p.databases[name]
+	return ok
 }
 
 func (p *Provisioner) HasUser(name string) bool {
-	return stringArrayContains(p.usernames, name)
+	_, ok := p.roles[name]
+	return ok
 }
 
-func (p *Provisioner) CreateDatabase(name string) error {
-	_, err := p.db.Exec(fmt.Sprintf("CREATE DATABASE %s", name))
+// DatabaseNames returns the names of all databases, in lexical order.
+func (p *Provisioner) DatabaseNames() []string {
+	names := make([]string, 0, len(p.databases))
+	for name := range p.databases {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// RoleNames returns the names of all roles, in lexical order.
+func (p *Provisioner) RoleNames() []string {
+	names := make([]string, 0, len(p.roles))
+	for name := range p.roles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// IsSystemRole reports whether the role is a predefined (pg_*) or bootstrap
+// role.
+func (p *Provisioner) IsSystemRole(name string) bool {
+	r, ok := p.roles[name]
+	return ok && r.System
+}
+
+// IsTemplateDatabase reports whether the database is a template database.
+func (p *Provisioner) IsTemplateDatabase(name string) bool {
+	d, ok := p.databases[name]
+	return ok && d.IsTemplate
+}
+
+// AllowsConnections reports whether connections to the database are allowed.
+func (p *Provisioner) AllowsConnections(name string) bool {
+	d, ok := p.databases[name]
+	return ok && d.AllowConnections
+}
+
+// CurrentDatabase returns the name of the database the Provisioner is
+// connected to.
+func (p *Provisioner) CurrentDatabase() string {
+	return p.currentDatabase
+}
+
+// DropDatabase drops a database. If force is set, other sessions connected to
+// the database are terminated first.
+func (p *Provisioner) DropDatabase(ctx context.Context, name string, force bool) error {
+	query := fmt.Sprintf("DROP DATABASE %s", quoteIdentifier(name))
+	if force {
+		if p.serverVersion >= 130000 {
+			query += " WITH (FORCE)"
+		} else {
+			err := p.execAutocommit(ctx, p.conn, "", Action{ObjectType: ObjectTypeDatabase, Object: name, Action: ActionAltered}, fmt.Sprintf(`SELECT pg_catalog.pg_terminate_backend(pid) FROM pg_catalog.pg_stat_activity
+WHERE datname = %s AND pid <> pg_catalog.pg_backend_pid()`, quoteLiteral(name)))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err := p.execAutocommit(ctx, p.conn, "", Action{ObjectType: ObjectTypeDatabase, Object: name, Action: ActionDropped}, query)
 	if err != nil {
 		return err
 	}
-	p.databaseNames = append(p.databaseNames, name)
+	delete(p.databases, name)
 	return nil
 }
 
-func (p *Provisioner) CreateUser(name string, password string) error {
-	_, err := p.db.Exec(fmt.Sprintf("CREATE USER %s", name))
+// DropRole drops a role. Objects owned by the role must first be reassigned or
+// dropped in every database, see DatabaseProvisioner.ReassignOwned and
+// DatabaseProvisioner.DropOwned.
+func (p *Provisioner) DropRole(ctx context.Context, name string) error {
+	err := p.exec(ctx, p.conn, "", Action{ObjectType: ObjectTypeRole, Object: name, Action: ActionDropped}, fmt.Sprintf("DROP ROLE %s", quoteIdentifier(name)))
 	if err != nil {
 		return err
 	}
-	if password != "" {
-		_, err = p.db.Exec(fmt.Sprintf("ALTER USER %s WITH PASSWORD '%s'", name, password))
-		if err != nil {
-			return err
+	delete(p.roles, name)
+	return nil
+}
+
+func (p *Provisioner) CreateDatabase(ctx context.Context, name string, options *DatabaseOptions) error {
+	d := &Database{
+		ConnectionLimit:  -1,
+		AllowConnections: true,
+	}
+	clauses := make([]string, 0)
+	if options != nil {
+		if options.Template != "" {
+			clauses = append(clauses, fmt.Sprintf("TEMPLATE %s", quoteIdentifier(options.Template)))
+		}
+		if options.Encoding != "" {
+			clauses = append(clauses, fmt.Sprintf("ENCODING %s", quoteLiteral(options.Encoding)))
+			d.Encoding = options.Encoding
+		}
+		if options.LcCollate != "" {
+			clauses = append(clauses, fmt.Sprintf("LC_COLLATE %s", quoteLiteral(options.LcCollate)))
+			d.LcCollate = options.LcCollate
+		}
+		if options.LcCtype != "" {
+			clauses = append(clauses, fmt.Sprintf("LC_CTYPE %s", quoteLiteral(options.LcCtype)))
+			d.LcCtype = options.LcCtype
+		}
+		if options.LocaleProvider != "" {
+			clauses = append(clauses, fmt.Sprintf("LOCALE_PROVIDER %s", quoteIdentifier(options.LocaleProvider)))
+			d.LocaleProvider = options.LocaleProvider
 		}
+		if options.IcuLocale != "" {
+			clauses = append(clauses, fmt.Sprintf("ICU_LOCALE %s", quoteLiteral(options.IcuLocale)))
+			d.IcuLocale = options.IcuLocale
+		}
+		if options.Tablespace != "" {
+			clauses = append(clauses, fmt.Sprintf("TABLESPACE %s", quoteIdentifier(options.Tablespace)))
+			d.Tablespace = options.Tablespace
+		}
+		clauses = append(clauses, options.mutableClauses(nil, d)...)
+	}
+	query := fmt.Sprintf("CREATE DATABASE %s", quoteIdentifier(name))
+	if len(clauses) > 0 {
+		query += " WITH " + strings.Join(clauses, " ")
+	}
+	err := p.execAutocommit(ctx, p.conn, "", Action{ObjectType: ObjectTypeDatabase, Object: name, Action: ActionCreated}, query)
+	if err != nil {
+		return err
 	}
-	p.usernames = append(p.usernames, name)
+	p.databases[name] = d
 	return nil
 }
 
-func (p *Provisioner) SetDatabaseOwner(databaseName string, userName string) error {
-	_, err := p.db.Exec(fmt.Sprintf("ALTER DATABASE %s OWNER TO %s", databaseName, userName))
+// SetDatabaseOptions brings the options of an existing database in line with
+// the specified options. Options that can only be applied when the database
+// is created are recorded as drift if they differ.
+func (p *Provisioner) SetDatabaseOptions(ctx context.Context, name string, options *DatabaseOptions) error {
+	current, ok := p.databases[name]
+	if !ok {
+		return fmt.Errorf("database %s does not exist", name)
+	}
+	if options == nil {
+		return nil
+	}
+	object := fmt.Sprintf("database %s", name)
+	immutables := []struct {
+		option    string
+		wanted    string
+		current   string
+		normalize func(string) string
+	}{
+		{"encoding", options.Encoding, current.Encoding, normalizeEncoding},
+		{"lc_collate", options.LcCollate, current.LcCollate, normalizeLocale},
+		{"lc_ctype", options.LcCtype, current.LcCtype, normalizeLocale},
+		{"locale_provider", options.LocaleProvider, current.LocaleProvider, nil},
+		{"icu_locale", options.IcuLocale, current.IcuLocale, nil},
+		{"tablespace", options.Tablespace, current.Tablespace, nil},
+	}
+	for _, immutable := range immutables {
+		wanted, current := immutable.wanted, immutable.current
+		if immutable.normalize != nil {
+			wanted, current = immutable.normalize(wanted), immutable.normalize(current)
+		}
+		if (wanted != "") && !strings.EqualFold(wanted, current) {
+			p.drifts = append(p.drifts, Drift{
+				Object:  object,
+				Message: fmt.Sprintf("%s is %q, config specifies %q", immutable.option, immutable.current, immutable.wanted),
+			})
+		}
+	}
+	d := *current
+	clauses := options.mutableClauses(current, &d)
+	if len(clauses) == 0 {
+		p.skip("", ObjectTypeDatabase, name)
+		return nil
+	}
+	err := p.exec(ctx, p.conn, "", Action{ObjectType: ObjectTypeDatabase, Object: name, Action: ActionAltered}, fmt.Sprintf("ALTER DATABASE %s WITH %s", quoteIdentifier(name), strings.Join(clauses, " ")))
 	if err != nil {
 		return err
 	}
+	p.databases[name] = &d
 	return nil
 }
 
-func SetDatabaseUser(db *sql.DB, userName string) error {
-	_, err := db.Exec(fmt.Sprintf("GRANT USAGE ON SCHEMA public TO %s", userName))
+// normalizeEncoding normalizes an encoding name, which PostgreSQL accepts in
+// any case and with or without hyphens and underscores, so that UTF-8 and UTF8
+// compare equal.
+func normalizeEncoding(encoding string) string {
+	return strings.NewReplacer("-", "", "_", "").Replace(encoding)
+}
+
+// normalizeLocale normalizes the codeset of a locale name, such as
+// en_US.UTF-8, which the C library accepts in any case and with or without
+// hyphens, so that en_US.UTF-8 and en_US.utf8 compare equal.
+func normalizeLocale(locale string) string {
+	name, codeset, ok := strings.Cut(locale, ".")
+	if !ok {
+		return locale
+	}
+	codeset, modifier, hasModifier := strings.Cut(codeset, "@")
+	codeset = strings.ReplaceAll(strings.ToLower(codeset), "-", "")
+	if hasModifier {
+		return name + "." + codeset + "@" + modifier
+	}
+	return name + "." + codeset
+}
+
+// mutableClauses returns the clauses for options that can be altered and that
+// differ from current, and applies them to updated. If current is nil, all
+// specified options are returned.
+func (o *DatabaseOptions) mutableClauses(current *Database, updated *Database) []string {
+	clauses := make([]string, 0)
+	if (o.ConnectionLimit != nil) && ((current == nil) || (*o.ConnectionLimit != current.ConnectionLimit)) {
+		clauses = append(clauses, fmt.Sprintf("CONNECTION LIMIT %d", *o.ConnectionLimit))
+		updated.ConnectionLimit = *o.ConnectionLimit
+	}
+	if (o.IsTemplate != nil) && ((current == nil) || (*o.IsTemplate != current.IsTemplate)) {
+		clauses = append(clauses, fmt.Sprintf("IS_TEMPLATE %s", boolKeyword(*o.IsTemplate)))
+		updated.IsTemplate = *o.IsTemplate
+	}
+	if (o.AllowConnections != nil) && ((current == nil) || (*o.AllowConnections != current.AllowConnections)) {
+		clauses = append(clauses, fmt.Sprintf("ALLOW_CONNECTIONS %s", boolKeyword(*o.AllowConnections)))
+		updated.AllowConnections = *o.AllowConnections
+	}
+	return clauses
+}
+
+// CreateUser creates a role that can log in. A non-empty password is set as
+// with SetPassword.
+func (p *Provisioner) CreateUser(ctx context.Context, name string, password string, attributes *RoleAttributes) error {
+	r := &Role{
+		Login:           true,
+		Inherit:         true,
+		ConnectionLimit: -1,
+	}
+	options := attributes.options(nil, r)
+	verifier := ""
+	if password != "" {
+		var err error
+		verifier, err = p.passwordVerifier(name, password)
+		if err != nil {
+			return err
+		}
+	}
+	query := fmt.Sprintf("CREATE USER %s", quoteIdentifier(name))
+	if len(options) > 0 {
+		query += " WITH " + strings.Join(options, " ")
+	}
+	err := p.exec(ctx, p.conn, "", Action{ObjectType: ObjectTypeRole, Object: name, Action: ActionCreated}, query)
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec(fmt.Sprintf("GRANT SELECT, UPDATE, INSERT, DELETE ON ALL TABLES IN SCHEMA public TO %s", userName))
+	if verifier != "" {
+		err = p.setPasswordVerifier(ctx, name, verifier, password)
+		if err != nil {
+			return err
+		}
+	}
+	p.roles[name] = r
+	return nil
+}
+
+// SetUserAttributes brings the attributes of an existing user in line with
+// the specified attributes. Only attributes that have drifted are altered.
+func (p *Provisioner) SetUserAttributes(ctx context.Context, name string, attributes *RoleAttributes) error {
+	current, ok := p.roles[name]
+	if !ok {
+		return fmt.Errorf("user %s does not exist", name)
+	}
+	if attributes == nil {
+		p.skip("", ObjectTypeRole, name)
+		return nil
+	}
+	r := *current
+	options := attributes.options(current, &r)
+	if attributes.ValidUntil != "" {
+		drifted, err := p.conn.ValidUntilDiffers(ctx, name, attributes.ValidUntil)
+		if err != nil {
+			return err
+		}
+		if !drifted {
+			options = slices.DeleteFunc(options, func(option string) bool {
+				return strings.HasPrefix(option, "VALID UNTIL ")
+			})
+		}
+	}
+	if len(options) == 0 {
+		p.skip("", ObjectTypeRole, name)
+		return nil
+	}
+	err := p.exec(ctx, p.conn, "", Action{ObjectType: ObjectTypeRole, Object: name, Action: ActionAltered}, fmt.Sprintf("ALTER ROLE %s WITH %s", quoteIdentifier(name), strings.Join(options, " ")))
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec(fmt.Sprintf("GRANT USAGE, SELECT ON ALL SEQUENCES IN SCHEMA public TO %s", userName))
+	p.roles[name] = &r
+	return nil
+}
+
+// options returns the role options that differ from current, and applies them
+// to updated. If current is nil, all specified options are returned.
+func (a *RoleAttributes) options(current *Role, updated *Role) []string {
+	if a == nil {
+		return nil
+	}
+	options := make([]string, 0)
+	flags := []struct {
+		value *bool
+		field *bool
+		on    string
+		off   string
+	}{
+		{a.Login, &updated.Login, "LOGIN", "NOLOGIN"},
+		{a.Superuser, &updated.Superuser, "SUPERUSER", "NOSUPERUSER"},
+		{a.CreateDB, &updated.CreateDB, "CREATEDB", "NOCREATEDB"},
+		{a.CreateRole, &updated.CreateRole, "CREATEROLE", "NOCREATEROLE"},
+		{a.Inherit, &updated.Inherit, "INHERIT", "NOINHERIT"},
+		{a.Replication, &updated.Replication, "REPLICATION", "NOREPLICATION"},
+		{a.BypassRLS, &updated.BypassRLS, "BYPASSRLS", "NOBYPASSRLS"},
+	}
+	for _, flag := range flags {
+		if flag.value == nil {
+			continue
+		}
+		if (current == nil) || (*flag.value != *flag.field) {
+			if *flag.value {
+				options = append(options, flag.on)
+			} else {
+				options = append(options, flag.off)
+			}
+		}
+		*flag.field = *flag.value
+	}
+	if a.ConnectionLimit != nil {
+		if (current == nil) || (*a.ConnectionLimit != updated.ConnectionLimit) {
+			options = append(options, fmt.Sprintf("CONNECTION LIMIT %d", *a.ConnectionLimit))
+		}
+		updated.ConnectionLimit = *a.ConnectionLimit
+	}
+	if a.ValidUntil != "" {
+		options = append(options, fmt.Sprintf("VALID UNTIL %s", quoteLiteral(a.ValidUntil)))
+	}
+	return options
+}
+
+// CreateGroup creates a group role, which cannot log in.
+func (p *Provisioner) CreateGroup(ctx context.Context, name string) error {
+	err := p.exec(ctx, p.conn, "", Action{ObjectType: ObjectTypeRole, Object: name, Action: ActionCreated}, fmt.Sprintf("CREATE ROLE %s", quoteIdentifier(name)))
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec(fmt.Sprintf("ALTER DEFAULT PRIVILEGES IN SCHEMA public GRANT SELECT, UPDATE, INSERT, DELETE ON TABLES TO %s", userName))
+	p.roles[name] = &Role{
+		Inherit:         true,
+		ConnectionLimit: -1,
+	}
+	return nil
+}
+
+// GetMemberships returns the current members of the specified group role.
+func (p *Provisioner) GetMemberships(ctx context.Context, groupName string) ([]*Membership, error) {
+	return p.conn.Memberships(ctx, groupName)
+}
+
+// HasPrivilegesOf reports whether the admin user holds the privileges of the
+// role, as a superuser, or as the role itself or a member inheriting from it.
+func (p *Provisioner) HasPrivilegesOf(ctx context.Context, roleName string) (bool, error) {
+	return p.conn.HasPrivilegesOf(ctx, roleName)
+}
+
+// GrantMembership grants membership in the group role, or updates the options
+// of an existing membership.
+func (p *Provisioner) GrantMembership(ctx context.Context, groupName string, membership *Membership) error {
+	options := make([]string, 0)
+	if membership.Admin {
+		options = append(options, "ADMIN OPTION")
+	}
+	if (membership.Inherit != nil) || (membership.Set != nil) {
+		if p.serverVersion < 160000 {
+			return fmt.Errorf("INHERIT and SET membership options require PostgreSQL 16 or later")
+		}
+		if membership.Admin {
+			options[0] = "ADMIN TRUE"
+		}
+		if membership.Inherit != nil {
+			options = append(options, fmt.Sprintf("INHERIT %s", boolKeyword(*membership.Inherit)))
+		}
+		if membership.Set != nil {
+			options = append(options, fmt.Sprintf("SET %s", boolKeyword(*membership.Set)))
+		}
+	}
+	query := fmt.Sprintf("GRANT %s TO %s", quoteIdentifier(groupName), quoteIdentifier(membership.Member))
+	if len(options) > 0 {
+		query += " WITH " + strings.Join(options, ", ")
+	}
+	return p.exec(ctx, p.conn, "", Action{ObjectType: ObjectTypeRole, Object: groupName, Grantee: membership.Member, Action: ActionGranted}, query)
+}
+
+// RevokeMembership revokes membership in the group role.
+func (p *Provisioner) RevokeMembership(ctx context.Context, groupName string, memberName string) error {
+	return p.exec(ctx, p.conn, "", Action{ObjectType: ObjectTypeRole, Object: groupName, Grantee: memberName, Action: ActionRevoked}, fmt.Sprintf("REVOKE %s FROM %s", quoteIdentifier(groupName), quoteIdentifier(memberName)))
+}
+
+// SetMemberships grants the specified memberships in the group role that are
+// missing or have different options, and revokes all other memberships except
+// those of system roles and of the retained roles. The admin user should be
+// retained: PostgreSQL 16 and later grant a role created by a non-superuser
+// to its creator, which needs that membership to manage the role.
+func (p *Provisioner) SetMemberships(ctx context.Context, groupName string, memberships []*Membership, retained []string) error {
+	current, err := p.GetMemberships(ctx, groupName)
 	if err != nil {
 		return err
 	}
-	_, err = db.Exec(fmt.Sprintf("ALTER DEFAULT PRIVILEGES IN SCHEMA public GRANT USAGE, SELECT ON SEQUENCES TO %s", userName))
+	currentByMember := make(map[string]*Membership)
+	for _, membership := range current {
+		currentByMember[membership.Member] = membership
+	}
+	wanted := make(map[string]bool)
+	for _, membership := range memberships {
+		wanted[membership.Member] = true
+		existing, ok := currentByMember[membership.Member]
+		if ok && (existing.Admin == membership.Admin) &&
+			boolOptionMatches(membership.Inherit, existing.Inherit) &&
+			boolOptionMatches(membership.Set, existing.Set) {
+			continue
+		}
+		if ok && existing.Admin && !membership.Admin {
+			err = p.exec(ctx, p.conn, "", Action{ObjectType: ObjectTypeRole, Object: groupName, Grantee: membership.Member, Action: ActionRevoked}, fmt.Sprintf("REVOKE ADMIN OPTION FOR %s FROM %s", quoteIdentifier(groupName), quoteIdentifier(membership.Member)))
+			if err != nil {
+				return err
+			}
+			if boolOptionMatches(membership.Inherit, existing.Inherit) &&
+				boolOptionMatches(membership.Set, existing.Set) {
+				continue
+			}
+		}
+		err = p.GrantMembership(ctx, groupName, membership)
+		if err != nil {
+			return err
+		}
+	}
+	for _, membership := range current {
+		if wanted[membership.Member] || slices.Contains(retained, membership.Member) || p.IsSystemRole(membership.Member) {
+			continue
+		}
+		err = p.RevokeMembership(ctx, groupName, membership.Member)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetDatabaseOwner returns the current owner of the specified database, or an
+// empty string if the database does not exist on the server.
+func (p *Provisioner) GetDatabaseOwner(databaseName string) string {
+	d, ok := p.databases[databaseName]
+	if !ok {
+		return ""
+	}
+	return d.Owner
+}
+
+// GetRoleAttributes returns the current attributes of the specified role, or
+// nil if the role does not exist. ValidUntil is not included.
+func (p *Provisioner) GetRoleAttributes(name string) *RoleAttributes {
+	current, ok := p.roles[name]
+	if !ok {
+		return nil
+	}
+	r := *current
+	return &RoleAttributes{
+		Login:           &r.Login,
+		Superuser:       &r.Superuser,
+		CreateDB:        &r.CreateDB,
+		CreateRole:      &r.CreateRole,
+		Inherit:         &r.Inherit,
+		Replication:     &r.Replication,
+		BypassRLS:       &r.BypassRLS,
+		ConnectionLimit: &r.ConnectionLimit,
+	}
+}
+
+// GetDatabaseOptions returns the current options of the specified database,
+// or nil if the database does not exist. Template is not included.
+func (p *Provisioner) GetDatabaseOptions(name string) *DatabaseOptions {
+	current, ok := p.databases[name]
+	if !ok {
+		return nil
+	}
+	d := *current
+	return &DatabaseOptions{
+		Encoding:         d.Encoding,
+		LcCollate:        d.LcCollate,
+		LcCtype:          d.LcCtype,
+		LocaleProvider:   d.LocaleProvider,
+		IcuLocale:        d.IcuLocale,
+		Tablespace:       d.Tablespace,
+		ConnectionLimit:  &d.ConnectionLimit,
+		IsTemplate:       &d.IsTemplate,
+		AllowConnections: &d.AllowConnections,
+	}
+}
+
+func (p *Provisioner) SetDatabaseOwner(ctx context.Context, databaseName string, userName string) error {
+	d, ok := p.databases[databaseName]
+	if !ok {
+		return fmt.Errorf("database %s does not exist", databaseName)
+	}
+	if d.Owner == userName {
+		p.skip("", ObjectTypeDatabase, databaseName)
+		return nil
+	}
+	err := p.exec(ctx, p.conn, "", Action{ObjectType: ObjectTypeDatabase, Object: databaseName, Action: ActionAltered}, fmt.Sprintf("ALTER DATABASE %s OWNER TO %s", quoteIdentifier(databaseName), quoteIdentifier(userName)))
 	if err != nil {
 		return err
 	}
+	d.Owner = userName
 	return nil
 }
 
-func stringArrayContains(values []string, value string) bool {
-	for _, v := range values {
-		if v == value {
-			return true
-		}
+func boolKeyword(value bool) string {
+	if value {
+		return "TRUE"
+	}
+	return "FALSE"
+}
+
+// boolOptionMatches reports whether an optional wanted value is satisfied by
+// the current value. An unspecified wanted value always matches.
+func boolOptionMatches(wanted *bool, current *bool) bool {
+	if wanted == nil {
+		return true
+	}
+	return (current != nil) && (*wanted == *current)
+}
+
+// quoteConnectionStringValue quotes a connection string value if it is empty
+// or contains whitespace, quotes or backslashes.
+func quoteConnectionStringValue(value string) string {
+	if (value != "") && !strings.ContainsAny(value, " \t\n\r'\\") {
+		return value
 	}
-	return false
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `'`, `\'`)
+	return "'" + value + "'"
 }
 
 func BuildConnectionString(dbname string, user string, password string, host string, port int, sslmode string) string {
 	connStrParts := make([]string, 0)
 	if dbname != "" {
-		connStrParts = append(connStrParts, fmt.Sprintf("dbname=%s", dbname))
+		connStrParts = append(connStrParts, fmt.Sprintf("dbname=%s", quoteConnectionStringValue(dbname)))
 	}
 	if user != "" {
-		connStrParts = append(connStrParts, fmt.Sprintf("user=%s", user))
+		connStrParts = append(connStrParts, fmt.Sprintf("user=%s", quoteConnectionStringValue(user)))
 	}
 	if password != "" {
-		connStrParts = append(connStrParts, fmt.Sprintf("password=%s", password))
+		connStrParts = append(connStrParts, fmt.Sprintf("password=%s", quoteConnectionStringValue(password)))
 	}
 	if host != "" {
-		connStrParts = append(connStrParts, fmt.Sprintf("host=%s", host))
+		connStrParts = append(connStrParts, fmt.Sprintf("host=%s", quoteConnectionStringValue(host)))
 	}
 	if (port != 0) && (port != 5432) {
 		connStrParts = append(connStrParts, fmt.Sprintf("port=%d", port))
 	}
 	if sslmode != "" {
-		connStrParts = append(connStrParts, fmt.Sprintf("sslmode=%s", sslmode))
+		connStrParts = append(connStrParts, fmt.Sprintf("sslmode=%s", quoteConnectionStringValue(sslmode)))
 	}
 	return strings.Join(connStrParts, " ")
 }
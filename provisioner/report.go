@@ -0,0 +1,95 @@
+package provisioner
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// Object types of actions.
+const (
+	ObjectTypeRole      = "role"
+	ObjectTypeDatabase  = "database"
+	ObjectTypeSchema    = "schema"
+	ObjectTypeExtension = "extension"
+)
+
+// Actions taken on objects.
+const (
+	ActionCreated = "created"
+	ActionAltered = "altered"
+	ActionGranted = "granted"
+	ActionRevoked = "revoked"
+	ActionDropped = "dropped"
+	ActionSkipped = "skipped"
+)
+
+// redacted replaces secrets in statements recorded by a Provisioner.
+const redacted = "'********'"
+
+// Action is an action taken (or, in dry-run mode, planned) by a Provisioner.
+// Skipped actions record objects that were already up to date, and have no
+// statement.
+type Action struct {
+	ObjectType string `json:"objectType"`
+	Object     string `json:"object"`
+	// Grantee is the role granted or revoked privileges or a membership.
+	Grantee string `json:"grantee,omitempty"`
+	Action  string `json:"action"`
+	// Database is the database the statement was executed in, or empty for
+	// the admin connection.
+	Database string `json:"database,omitempty"`
+	// Statement is the statement executed, with passwords redacted.
+	Statement string `json:"statement,omitempty"`
+	// Transaction numbers the transaction the statement was executed in, from
+	// 1 in order. It is 0 for statements that cannot run in a transaction,
+	// such as CREATE DATABASE, which are executed on their own.
+	Transaction int           `json:"transaction,omitempty"`
+	Duration    time.Duration `json:"duration,omitempty"`
+	Error       string        `json:"error,omitempty"`
+	// Committed is set once the statement has taken effect: when its
+	// transaction is committed, or when it succeeds outside a transaction.
+	Committed bool `json:"committed,omitempty"`
+	// RolledBack is set when the transaction of the statement was rolled
+	// back.
+	RolledBack bool `json:"rolledBack,omitempty"`
+}
+
+// MarshalJSON writes the duration as a string such as "1.5ms".
+func (a Action) MarshalJSON() ([]byte, error) {
+	type action Action
+	duration := ""
+	if a.Duration != 0 {
+		duration = a.Duration.String()
+	}
+	return json.Marshal(struct {
+		action
+		Duration string `json:"duration,omitempty"`
+	}{
+		action:   action(a),
+		Duration: duration,
+	})
+}
+
+// Report is the result of a run of a ConfigProvisioner. If the run failed, it
+// holds the actions up to and including the one that failed; actions of the
+// transaction that was in progress are marked as rolled back.
+type Report struct {
+	DryRun  bool     `json:"dryRun"`
+	Actions []Action `json:"actions"`
+	Drifts  []Drift  `json:"drifts,omitempty"`
+}
+
+// sameObject reports whether the actions are on the same object in the same
+// database.
+func (a Action) sameObject(other Action) bool {
+	return (a.Database == other.Database) && (a.ObjectType == other.ObjectType) && (a.Object == other.Object)
+}
+
+// redact replaces the string literals of secrets in a statement.
+func redact(query string, secrets []string) string {
+	for _, secret := range secrets {
+		query = strings.ReplaceAll(query, quoteLiteral(secret), redacted)
+	}
+	return query
+}
@@ -0,0 +1,107 @@
+package provisioner
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// listSettings are settings whose values are lists, which the server
+// normalizes when storing them.
+var listSettings = []string{
+	"search_path",
+	"temp_tablespaces",
+	"local_preload_libraries",
+	"session_preload_libraries",
+	"shared_preload_libraries",
+}
+
+// GetSettings returns the runtime settings for the role in the database, as
+// stored in pg_db_role_setting. An empty databaseName or roleName applies to
+// all databases or all roles respectively.
+func (p *Provisioner) GetSettings(ctx context.Context, databaseName string, roleName string) (map[string]string, error) {
+	return p.conn.Settings(ctx, databaseName, roleName)
+}
+
+// SetSettings applies the runtime settings for the role in the database that
+// are missing or have different values, and resets all other settings. An
+// empty databaseName or roleName applies to all databases or all roles
+// respectively.
+func (p *Provisioner) SetSettings(ctx context.Context, databaseName string, roleName string, settings map[string]string) error {
+	var target string
+	action := Action{ObjectType: ObjectTypeRole, Object: roleName, Action: ActionAltered}
+	if roleName == "" {
+		target = fmt.Sprintf("ALTER DATABASE %s", quoteIdentifier(databaseName))
+		action = Action{ObjectType: ObjectTypeDatabase, Object: databaseName, Action: ActionAltered}
+	} else if databaseName == "" {
+		target = fmt.Sprintf("ALTER ROLE %s", quoteIdentifier(roleName))
+	} else {
+		target = fmt.Sprintf("ALTER ROLE %s IN DATABASE %s", quoteIdentifier(roleName), quoteIdentifier(databaseName))
+	}
+
+	current, err := p.GetSettings(ctx, databaseName, roleName)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := settings[key]
+		currentValue, ok := current[key]
+		if ok && settingValuesEqual(key, currentValue, value) {
+			continue
+		}
+		err = p.exec(ctx, p.conn, "", action, fmt.Sprintf("%s SET %s = %s", target, quoteQualifiedIdentifier(key), settingValueLiteral(key, value)))
+		if err != nil {
+			return err
+		}
+	}
+
+	keys = make([]string, 0, len(current))
+	for key := range current {
+		if _, ok := settings[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		err = p.exec(ctx, p.conn, "", action, fmt.Sprintf("%s RESET %s", target, quoteQualifiedIdentifier(key)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func settingValueLiteral(key string, value string) string {
+	if !slices.Contains(listSettings, strings.ToLower(key)) {
+		return quoteLiteral(value)
+	}
+	elements := splitSettingList(value)
+	for i, element := range elements {
+		elements[i] = quoteLiteral(element)
+	}
+	return strings.Join(elements, ", ")
+}
+
+func settingValuesEqual(key string, a string, b string) bool {
+	if !slices.Contains(listSettings, strings.ToLower(key)) {
+		return a == b
+	}
+	return slices.Equal(splitSettingList(a), splitSettingList(b))
+}
+
+func splitSettingList(value string) []string {
+	elements := strings.Split(value, ",")
+	for i, element := range elements {
+		elements[i] = strings.Trim(strings.TrimSpace(element), `"`)
+	}
+	return elements
+}
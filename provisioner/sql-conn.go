@@ -0,0 +1,494 @@
+package provisioner
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// relkinds are the pg_class relkinds of each object type.
+var relkinds = map[string]string{
+	ObjectTables:    "'r', 'p', 'v', 'm', 'f'",
+	ObjectSequences: "'S'",
+}
+
+// privilegeFuncs are the functions checking the privileges of a role on a
+// relation of each object type.
+var privilegeFuncs = map[string]string{
+	ObjectTables:    "has_table_privilege",
+	ObjectSequences: "has_sequence_privilege",
+}
+
+// defaultACLTypes are the pg_default_acl object types of each object type.
+var defaultACLTypes = map[string]string{
+	ObjectTables:    "r",
+	ObjectSequences: "S",
+}
+
+// querier is implemented by *sql.DB and *sql.Tx.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+type sqlConn struct {
+	db *sql.DB
+	tx *sql.Tx
+	// lockConn is the session holding advisory locks, as they are released
+	// when the session ends.
+	lockConn      *sql.Conn
+	serverVersion int
+}
+
+// NewSQLConn returns a Conn that reads the catalog of a PostgreSQL server and
+// executes statements through db.
+func NewSQLConn(db *sql.DB) Conn {
+	return &sqlConn{
+		db: db,
+	}
+}
+
+func (c *sqlConn) Exec(ctx context.Context, query string) error {
+	_, err := c.querier().ExecContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (c *sqlConn) Close() error {
+	if c.tx != nil {
+		_ = c.tx.Rollback()
+		c.tx = nil
+	}
+	if c.lockConn != nil {
+		_ = c.lockConn.Close()
+		c.lockConn = nil
+	}
+	return c.db.Close()
+}
+
+func (c *sqlConn) TryAdvisoryLock(ctx context.Context, key int64) (bool, error) {
+	if c.lockConn == nil {
+		lockConn, err := c.db.Conn(ctx)
+		if err != nil {
+			return false, err
+		}
+		c.lockConn = lockConn
+	}
+	var locked bool
+	err := c.lockConn.QueryRowContext(ctx, "SELECT pg_catalog.pg_try_advisory_lock($1)", key).Scan(&locked)
+	if err != nil {
+		return false, err
+	}
+	return locked, nil
+}
+
+func (c *sqlConn) AdvisoryUnlock(ctx context.Context, key int64) error {
+	if c.lockConn == nil {
+		return fmt.Errorf("advisory lock %d is not held", key)
+	}
+	var unlocked bool
+	err := c.lockConn.QueryRowContext(ctx, "SELECT pg_catalog.pg_advisory_unlock($1)", key).Scan(&unlocked)
+	if err != nil {
+		return err
+	}
+	if !unlocked {
+		return fmt.Errorf("advisory lock %d is not held", key)
+	}
+	return nil
+}
+
+// querier returns the transaction in progress, if any, or the database.
+func (c *sqlConn) querier() querier {
+	if c.tx != nil {
+		return c.tx
+	}
+	return c.db
+}
+
+func (c *sqlConn) Begin(ctx context.Context) error {
+	if c.tx != nil {
+		return fmt.Errorf("transaction already in progress")
+	}
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	c.tx = tx
+	return nil
+}
+
+func (c *sqlConn) Commit() error {
+	if c.tx == nil {
+		return fmt.Errorf("no transaction in progress")
+	}
+	tx := c.tx
+	c.tx = nil
+	return tx.Commit()
+}
+
+func (c *sqlConn) Rollback() error {
+	if c.tx == nil {
+		return fmt.Errorf("no transaction in progress")
+	}
+	tx := c.tx
+	c.tx = nil
+	return tx.Rollback()
+}
+
+func (c *sqlConn) ServerVersion(ctx context.Context) (int, error) {
+	if c.serverVersion != 0 {
+		return c.serverVersion, nil
+	}
+	err := c.querier().QueryRowContext(ctx, "SELECT pg_catalog.current_setting('server_version_num')::int").Scan(&c.serverVersion)
+	if err != nil {
+		return 0, err
+	}
+	return c.serverVersion, nil
+}
+
+func (c *sqlConn) InRecovery(ctx context.Context) (bool, error) {
+	return c.queryBool(ctx, "SELECT pg_catalog.pg_is_in_recovery()")
+}
+
+func (c *sqlConn) CurrentDatabase(ctx context.Context) (string, error) {
+	var currentDatabase string
+	err := c.querier().QueryRowContext(ctx, "SELECT pg_catalog.current_database()").Scan(&currentDatabase)
+	if err != nil {
+		return "", err
+	}
+	return currentDatabase, nil
+}
+
+func (c *sqlConn) Roles(ctx context.Context) (map[string]*Role, error) {
+	rows, err := c.querier().QueryContext(ctx, `SELECT rolname, rolcanlogin, rolsuper, rolcreatedb, rolcreaterole, rolinherit,
+  rolreplication, rolbypassrls, rolconnlimit, (rolname LIKE 'pg\_%' OR oid < 16384)
+FROM pg_catalog.pg_roles`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	roles := make(map[string]*Role)
+	for {
+		if !rows.Next() {
+			break
+		}
+		var name string
+		var r Role
+		err = rows.Scan(&name, &r.Login, &r.Superuser, &r.CreateDB, &r.CreateRole, &r.Inherit,
+			&r.Replication, &r.BypassRLS, &r.ConnectionLimit, &r.System)
+		if err != nil {
+			return nil, err
+		}
+		roles[name] = &r
+	}
+	return roles, nil
+}
+
+func (c *sqlConn) Databases(ctx context.Context) (map[string]*Database, error) {
+	serverVersion, err := c.ServerVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	localeColumns := "NULL::text, NULL::text"
+	if serverVersion >= 170000 {
+		localeColumns = "d.datlocprovider::text, d.datlocale"
+	} else if serverVersion >= 150000 {
+		localeColumns = "d.datlocprovider::text, d.daticulocale"
+	}
+	rows, err := c.querier().QueryContext(ctx, fmt.Sprintf(`SELECT d.datname, pg_catalog.pg_get_userbyid(d.datdba),
+  pg_catalog.pg_encoding_to_char(d.encoding), d.datcollate, d.datctype, %s,
+  t.spcname, d.datconnlimit, d.datistemplate, d.datallowconn
+FROM pg_catalog.pg_database d
+JOIN pg_catalog.pg_tablespace t ON t.oid = d.dattablespace`, localeColumns))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	databases := make(map[string]*Database)
+	for {
+		if !rows.Next() {
+			break
+		}
+		var name string
+		var d Database
+		var localeProvider sql.NullString
+		var icuLocale sql.NullString
+		err = rows.Scan(&name, &d.Owner, &d.Encoding, &d.LcCollate, &d.LcCtype, &localeProvider, &icuLocale,
+			&d.Tablespace, &d.ConnectionLimit, &d.IsTemplate, &d.AllowConnections)
+		if err != nil {
+			return nil, err
+		}
+		switch localeProvider.String {
+		case "i":
+			d.LocaleProvider = "icu"
+		case "b":
+			d.LocaleProvider = "builtin"
+		default:
+			d.LocaleProvider = "libc"
+		}
+		d.IcuLocale = icuLocale.String
+		databases[name] = &d
+	}
+	return databases, nil
+}
+
+func (c *sqlConn) ValidUntilDiffers(ctx context.Context, roleName string, validUntil string) (bool, error) {
+	var differs bool
+	err := c.querier().QueryRowContext(ctx, "SELECT rolvaliduntil IS DISTINCT FROM $2::timestamptz FROM pg_catalog.pg_roles WHERE rolname = $1",
+		roleName, validUntil).Scan(&differs)
+	if errors.Is(err, sql.ErrNoRows) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return differs, nil
+}
+
+func (c *sqlConn) Memberships(ctx context.Context, groupName string) ([]*Membership, error) {
+	serverVersion, err := c.ServerVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	query := `SELECT m.rolname, bool_or(am.admin_option), NULL::boolean, NULL::boolean
+FROM pg_catalog.pg_auth_members am
+JOIN pg_catalog.pg_roles g ON g.oid = am.roleid
+JOIN pg_catalog.pg_roles m ON m.oid = am.member
+WHERE g.rolname = $1
+GROUP BY m.rolname`
+	if serverVersion >= 160000 {
+		query = `SELECT m.rolname, bool_or(am.admin_option), bool_or(am.inherit_option), bool_or(am.set_option)
+FROM pg_catalog.pg_auth_members am
+JOIN pg_catalog.pg_roles g ON g.oid = am.roleid
+JOIN pg_catalog.pg_roles m ON m.oid = am.member
+WHERE g.rolname = $1
+GROUP BY m.rolname`
+	}
+	rows, err := c.querier().QueryContext(ctx, query, groupName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	memberships := make([]*Membership, 0)
+	for {
+		if !rows.Next() {
+			break
+		}
+		var membership Membership
+		var inherit sql.NullBool
+		var set sql.NullBool
+		err = rows.Scan(&membership.Member, &membership.Admin, &inherit, &set)
+		if err != nil {
+			return nil, err
+		}
+		if inherit.Valid {
+			membership.Inherit = &inherit.Bool
+		}
+		if set.Valid {
+			membership.Set = &set.Bool
+		}
+		memberships = append(memberships, &membership)
+	}
+	return memberships, nil
+}
+
+func (c *sqlConn) Settings(ctx context.Context, databaseName string, roleName string) (map[string]string, error) {
+	var config pq.StringArray
+	rows, err := c.querier().QueryContext(ctx, `SELECT s.setconfig
+FROM pg_catalog.pg_db_role_setting s
+WHERE s.setdatabase = CASE WHEN $1 = '' THEN 0 ELSE (SELECT oid FROM pg_catalog.pg_database WHERE datname = $1) END
+AND s.setrole = CASE WHEN $2 = '' THEN 0 ELSE (SELECT oid FROM pg_catalog.pg_roles WHERE rolname = $2) END`,
+		databaseName, roleName)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for {
+		if !rows.Next() {
+			break
+		}
+		err = rows.Scan(&config)
+		if err != nil {
+			return nil, err
+		}
+	}
+	settings := make(map[string]string)
+	for _, entry := range config {
+		key, value, _ := strings.Cut(entry, "=")
+		settings[key] = value
+	}
+	return settings, nil
+}
+
+func (c *sqlConn) CanReadPasswordVerifiers(ctx context.Context) (bool, error) {
+	return c.queryBool(ctx, "SELECT pg_catalog.has_table_privilege('pg_catalog.pg_authid', 'SELECT')")
+}
+
+func (c *sqlConn) PasswordVerifier(ctx context.Context, roleName string) (string, error) {
+	var verifier sql.NullString
+	err := c.querier().QueryRowContext(ctx, "SELECT rolpassword FROM pg_catalog.pg_authid WHERE rolname = $1", roleName).Scan(&verifier)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return verifier.String, nil
+}
+
+func (c *sqlConn) HasPrivilegesOf(ctx context.Context, roleName string) (bool, error) {
+	return c.queryBool(ctx, "SELECT pg_catalog.pg_has_role($1, 'USAGE')", roleName)
+}
+
+func (c *sqlConn) ExtensionAvailable(ctx context.Context, name string, version string) (bool, error) {
+	return c.queryBool(ctx, `SELECT EXISTS (
+  SELECT 1 FROM pg_catalog.pg_available_extension_versions
+  WHERE name = $1 AND ($2 = '' OR version = $2))`, name, version)
+}
+
+func (c *sqlConn) Extensions(ctx context.Context) ([]Extension, error) {
+	rows, err := c.querier().QueryContext(ctx, `SELECT e.extname, n.nspname, e.extversion
+FROM pg_catalog.pg_extension e
+JOIN pg_catalog.pg_namespace n ON n.oid = e.extnamespace
+ORDER BY e.extname`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	extensions := make([]Extension, 0)
+	for {
+		if !rows.Next() {
+			break
+		}
+		var extension Extension
+		err = rows.Scan(&extension.Name, &extension.Schema, &extension.Version)
+		if err != nil {
+			return nil, err
+		}
+		extensions = append(extensions, extension)
+	}
+	return extensions, nil
+}
+
+func (c *sqlConn) SchemaOwner(ctx context.Context, schemaName string) (string, error) {
+	var owner string
+	err := c.querier().QueryRowContext(ctx, "SELECT pg_catalog.pg_get_userbyid(nspowner) FROM pg_catalog.pg_namespace WHERE nspname = $1",
+		schemaName).Scan(&owner)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return owner, nil
+}
+
+func (c *sqlConn) SchemaNames(ctx context.Context) ([]string, error) {
+	return c.queryStrings(ctx, `SELECT COALESCE(array_agg(nspname::text ORDER BY nspname), '{}')
+FROM pg_catalog.pg_namespace
+WHERE nspname NOT LIKE 'pg\_%' AND nspname <> 'information_schema'`)
+}
+
+func (c *sqlConn) SchemaPrivileges(ctx context.Context, schemaName string, roleName string) ([]string, error) {
+	return c.queryStrings(ctx, `SELECT COALESCE(array_agg(DISTINCT a.privilege_type::text), '{}')
+FROM pg_catalog.pg_namespace n
+CROSS JOIN LATERAL pg_catalog.aclexplode(n.nspacl) AS a
+WHERE n.nspname = $1
+AND a.grantee = (SELECT oid FROM pg_catalog.pg_roles WHERE rolname = $2)`, schemaName, roleName)
+}
+
+func (c *sqlConn) HasSchemaPrivileges(ctx context.Context, schemaName string, roleName string, privileges []string) (bool, error) {
+	return c.queryBool(ctx, `SELECT COALESCE(bool_and(pg_catalog.has_schema_privilege(
+    (SELECT oid FROM pg_catalog.pg_roles WHERE rolname = $2), n.oid, p.privilege) IS TRUE), false)
+FROM pg_catalog.pg_namespace n
+CROSS JOIN unnest($3::text[]) AS p(privilege)
+WHERE n.nspname = $1`, schemaName, roleName, pq.Array(privileges))
+}
+
+func (c *sqlConn) RelationPrivileges(ctx context.Context, objectType string, schemaName string, roleName string) ([]string, error) {
+	return c.queryStrings(ctx, fmt.Sprintf(`SELECT COALESCE(array_agg(DISTINCT a.privilege_type::text), '{}')
+FROM pg_catalog.pg_class c
+JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+CROSS JOIN LATERAL pg_catalog.aclexplode(c.relacl) AS a
+WHERE n.nspname = $1 AND c.relkind IN (%s)
+AND a.grantee = (SELECT oid FROM pg_catalog.pg_roles WHERE rolname = $2)`, relkinds[objectType]), schemaName, roleName)
+}
+
+func (c *sqlConn) HasRelationPrivileges(ctx context.Context, objectType string, schemaName string, roleName string, privileges []string) (bool, error) {
+	return c.queryBool(ctx, fmt.Sprintf(`SELECT NOT EXISTS (
+  SELECT 1 FROM pg_catalog.pg_class c
+  JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+  CROSS JOIN unnest($3::text[]) AS p(privilege)
+  WHERE n.nspname = $1 AND c.relkind IN (%s)
+  AND pg_catalog.%s(
+    (SELECT oid FROM pg_catalog.pg_roles WHERE rolname = $2), c.oid, p.privilege) IS NOT TRUE)`,
+		relkinds[objectType], privilegeFuncs[objectType]),
+		schemaName, roleName, pq.Array(privileges))
+}
+
+func (c *sqlConn) DefaultPrivileges(ctx context.Context, objectType string, schemaName string, creatorName string, roleName string) ([]string, error) {
+	return c.queryStrings(ctx, `SELECT COALESCE(array_agg(DISTINCT a.privilege_type::text), '{}')
+FROM pg_catalog.pg_default_acl d
+JOIN pg_catalog.pg_namespace n ON n.oid = d.defaclnamespace
+CROSS JOIN LATERAL pg_catalog.aclexplode(d.defaclacl) AS a
+WHERE n.nspname = $1 AND d.defaclobjtype = $2
+AND ($3 = '' OR d.defaclrole = (SELECT oid FROM pg_catalog.pg_roles WHERE rolname = $3))
+AND a.grantee = (SELECT oid FROM pg_catalog.pg_roles WHERE rolname = $4)`, schemaName, defaultACLTypes[objectType], creatorName, roleName)
+}
+
+func (c *sqlConn) DefaultPrivilegeCreators(ctx context.Context, schemaName string, roleName string) ([]string, error) {
+	return c.queryStrings(ctx, `SELECT COALESCE(array_agg(DISTINCT pg_catalog.pg_get_userbyid(d.defaclrole)::text), '{}')
+FROM pg_catalog.pg_default_acl d
+JOIN pg_catalog.pg_namespace n ON n.oid = d.defaclnamespace
+CROSS JOIN LATERAL pg_catalog.aclexplode(d.defaclacl) AS a
+WHERE n.nspname = $1
+AND a.grantee = (SELECT oid FROM pg_catalog.pg_roles WHERE rolname = $2)`, schemaName, roleName)
+}
+
+func (c *sqlConn) Grantees(ctx context.Context, schemaName string) ([]string, error) {
+	return c.queryStrings(ctx, `SELECT COALESCE(array_agg(DISTINCT r.rolname::text), '{}')
+FROM (
+  SELECT a.grantee
+  FROM pg_catalog.pg_namespace n
+  CROSS JOIN LATERAL pg_catalog.aclexplode(n.nspacl) AS a
+  WHERE n.nspname = $1 AND a.grantee <> n.nspowner
+  UNION
+  SELECT a.grantee
+  FROM pg_catalog.pg_class c
+  JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+  CROSS JOIN LATERAL pg_catalog.aclexplode(c.relacl) AS a
+  WHERE n.nspname = $1 AND c.relkind IN ('r', 'p', 'v', 'm', 'f', 'S') AND a.grantee <> c.relowner
+  UNION
+  SELECT a.grantee
+  FROM pg_catalog.pg_default_acl d
+  JOIN pg_catalog.pg_namespace n ON n.oid = d.defaclnamespace
+  CROSS JOIN LATERAL pg_catalog.aclexplode(d.defaclacl) AS a
+  WHERE n.nspname = $1 AND a.grantee <> d.defaclrole
+) g
+JOIN pg_catalog.pg_roles r ON r.oid = g.grantee`, schemaName)
+}
+
+func (c *sqlConn) queryBool(ctx context.Context, query string, args ...any) (bool, error) {
+	var result bool
+	err := c.querier().QueryRowContext(ctx, query, args...).Scan(&result)
+	if err != nil {
+		return false, err
+	}
+	return result, nil
+}
+
+func (c *sqlConn) queryStrings(ctx context.Context, query string, args ...any) ([]string, error) {
+	var result pq.StringArray
+	err := c.querier().QueryRowContext(ctx, query, args...).Scan(&result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
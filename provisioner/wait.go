@@ -0,0 +1,84 @@
+package provisioner
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	ssh_helper "github.com/ngyewch/go-ssh-helper"
+	"github.com/ngyewch/pq-provisioner/config"
+)
+
+const (
+	waitInitialDelay = 250 * time.Millisecond
+	waitMaxDelay     = 5 * time.Second
+)
+
+// Wait polls the server until it accepts connections and is not in recovery,
+// backing off exponentially between attempts, or until the timeout elapses.
+// Each attempt connects afresh, through the ssh proxy if the config specifies
+// one, so that Wait also waits for the proxy to come up. A zero timeout waits
+// until the context is done.
+func Wait(ctx context.Context, cfg *config.Main, sshClientFactory *ssh_helper.SSHClientFactory, timeout time.Duration, options ...Option) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	delay := waitInitialDelay
+	for attempt := 1; ; attempt++ {
+		err := checkReady(ctx, cfg, sshClientFactory, options...)
+		if err == nil {
+			log.LogAttrs(ctx, slog.LevelInfo, "Server is ready",
+				slog.Int("attempt", attempt),
+			)
+			return nil
+		}
+		log.LogAttrs(ctx, slog.LevelInfo, "Server is not ready",
+			slog.Int("attempt", attempt),
+			slog.String("error", err.Error()),
+			slog.Duration("retryIn", delay),
+		)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return fmt.Errorf("server is not ready after %d attempts: %w", attempt, err)
+		case <-timer.C:
+		}
+		delay = min(delay*2, waitMaxDelay)
+	}
+}
+
+// checkReady connects to the admin database once, and checks that the server
+// is not in recovery.
+func checkReady(ctx context.Context, cfg *config.Main, sshClientFactory *ssh_helper.SSHClientFactory, options ...Option) error {
+	p, err := NewConfigProvisioner(ctx, cfg, sshClientFactory, options...)
+	if err != nil {
+		return err
+	}
+	defer func(p *ConfigProvisioner) {
+		_ = p.Close()
+	}(p)
+
+	conn, err := p.openDB(ctx, cfg.Database, cfg.User)
+	if err != nil {
+		return err
+	}
+	defer func(conn Conn) {
+		_ = conn.Close()
+	}(conn)
+
+	inRecovery, err := conn.InRecovery(ctx)
+	if err != nil {
+		return err
+	}
+	if inRecovery {
+		return errors.New("server is in recovery")
+	}
+	return nil
+}
@@ -0,0 +1,316 @@
+package test
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ngyewch/pq-provisioner/config"
+)
+
+func writeConfig(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigInterpolation(t *testing.T) {
+	t.Setenv("PQ_TEST_PASSWORD", "s3cr$t")
+	t.Setenv("PQ_TEST_EMPTY", "")
+
+	path := writeConfig(t, "config.toml", `
+user = "postgres"
+host = "${PQ_TEST_HOST:-localhost}"
+statementTimeout = "${PQ_TEST_TIMEOUT:-5m}"
+
+[[users]]
+name = "app_${PQ_TEST_EMPTY:-user}"
+password = "${PQ_TEST_PASSWORD}"
+settings = { search_path = "$${literal}, $user" }
+
+[[databases]]
+name = "test"
+owner = "app_user"
+users = ["${PQ_TEST_USER:-app_user}"]
+`)
+	cfg, err := config.LoadFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Host != "localhost" {
+		t.Errorf("host: got %q", cfg.Host)
+	}
+	if cfg.StatementTimeout != 5*time.Minute {
+		t.Errorf("statementTimeout: got %s", cfg.StatementTimeout)
+	}
+	user := cfg.GetUser("app_user")
+	if user == nil {
+		t.Fatal("user app_user not found")
+	}
+	if user.Password != "s3cr$t" {
+		t.Errorf("password: got %q", user.Password)
+	}
+	if user.Settings["search_path"] != "${literal}, $user" {
+		t.Errorf("search_path: got %q", user.Settings["search_path"])
+	}
+	if cfg.Databases[0].Users[0].Name != "app_user" {
+		t.Errorf("database user: got %q", cfg.Databases[0].Users[0].Name)
+	}
+
+	path = writeConfig(t, "config.toml", `
+user = "postgres"
+
+[[users]]
+name = "app_user"
+password = "${PQ_TEST_UNSET}"
+`)
+	_, err = config.LoadFromFile(path)
+	if (err == nil) || !strings.Contains(err.Error(), "PQ_TEST_UNSET is not set") {
+		t.Errorf("expected an error for an unset variable, got %v", err)
+	}
+}
+
+func TestConfigPasswordSources(t *testing.T) {
+	path := writeConfig(t, "config.toml", `
+user = "postgres"
+
+[[users]]
+name = "app_user"
+password = "secret"
+passwordFile = "/run/secrets/app_user"
+`)
+	_, err := config.LoadFromFile(path)
+	if (err == nil) || !strings.Contains(err.Error(), "only one of") {
+		t.Errorf("expected an error for multiple password sources, got %v", err)
+	}
+}
+
+func TestConfigProtectedAbsent(t *testing.T) {
+	path := writeConfig(t, "config.toml", `
+user = "postgres"
+
+[[databases]]
+name = "app"
+owner = "app_user"
+state = "absent"
+protected = true
+`)
+	_, err := config.LoadFromFile(path)
+	if (err == nil) || !strings.Contains(err.Error(), "database app is protected") {
+		t.Errorf("expected an error for a protected absent database, got %v", err)
+	}
+}
+
+func TestConfigEncryption(t *testing.T) {
+	key, err := config.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := config.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte(`user = "postgres" # admin user
+
+[[users]]
+name = "app_user"
+password = "app \"user\" password"  # to be encrypted
+
+[[users]]
+name = "app_reader"
+password = "${PQ_TEST_PASSWORD:-app_reader_password}"
+`)
+	data, count, err := config.EncryptValues(data, "toml", key, []string{"password"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected 1 value encrypted, got %d", count)
+	}
+	if strings.Contains(string(data), "app \\\"user\\\" password") || !strings.Contains(string(data), "# to be encrypted") {
+		t.Errorf("unexpected encrypted config:\n%s", data)
+	}
+
+	data, count, err = config.RotateKey(data, "toml", key, newKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected 1 value re-encrypted, got %d", count)
+	}
+
+	path := writeConfig(t, "config.toml", string(data))
+	t.Setenv(config.KeyEnv, key.String())
+	_, err = config.LoadFromFile(path)
+	if err == nil {
+		t.Error("expected decryption with the old key to fail")
+	}
+
+	t.Setenv(config.KeyEnv, newKey.String())
+	cfg, err := config.LoadFromFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if password := cfg.GetUser("app_user").Password; password != `app "user" password` {
+		t.Errorf("app_user password: got %q", password)
+	}
+	if password := cfg.GetUser("app_reader").Password; password != "app_reader_password" {
+		t.Errorf("app_reader password: got %q", password)
+	}
+}
+
+func TestConfigComposition(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name string, content string) {
+		path := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(path), 0o700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = os.WriteFile(path, []byte(content), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeFile("main.toml", `
+include = ["conf.d/10-users.toml", "conf.d"]
+user = "postgres"
+
+[[databases]]
+name = "app"
+owner = "app_user"
+users = ["app_user"]
+`)
+	writeFile("conf.d/10-users.toml", `
+[[users]]
+name = "app_user"
+password = "app_user_password"
+`)
+	writeFile("conf.d/20-databases.yaml", `
+databases:
+  - name: app
+    users:
+      - app_reader
+users:
+  - name: app_reader
+    password: app_reader_password
+`)
+	writeFile("conf.d/README.md", "not a config file")
+
+	stdin := strings.NewReader(`{"users": [{"name": "app_user", "password": "app_user_password"}]}`)
+	cfg, err := config.LoadFromPaths([]string{filepath.Join(dir, "main.toml"), "-"}, stdin, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.User != "postgres" {
+		t.Errorf("unexpected user %q", cfg.User)
+	}
+	if len(cfg.Users) != 2 {
+		t.Fatalf("expected 2 users, got %d", len(cfg.Users))
+	}
+	if len(cfg.Databases) != 1 {
+		t.Fatalf("expected 1 database, got %d", len(cfg.Databases))
+	}
+	database := cfg.Databases[0]
+	if (database.Owner != "app_user") || (len(database.Users) != 2) {
+		t.Errorf("unexpected merged database %+v", database)
+	}
+
+	_, err = config.LoadFromPaths([]string{"-"}, strings.NewReader(`user = "postgres"`), "")
+	if err == nil {
+		t.Error("expected reading stdin without a format to fail")
+	}
+
+	writeFile("cycle.toml", `include = "cycle.toml"`)
+	_, err = config.LoadFromPaths([]string{filepath.Join(dir, "cycle.toml")}, nil, "")
+	if err == nil {
+		t.Error("expected an include cycle to fail")
+	}
+
+	writeFile("conflict.toml", `
+[[users]]
+name = "app_user"
+password = "other_password"
+`)
+	_, err = config.LoadFromPaths([]string{filepath.Join(dir, "main.toml"), filepath.Join(dir, "conflict.toml")}, nil, "")
+	if err == nil {
+		t.Fatal("expected conflicting passwords to fail")
+	}
+	if !strings.Contains(err.Error(), "users[app_user].password") || strings.Contains(err.Error(), "other_password") {
+		t.Errorf("unexpected conflict error: %v", err)
+	}
+
+	writeFile("port.toml", `
+user = "postgres"
+port = 5432
+statementTimeout = "5m"
+`)
+	writeFile("port.yaml", `
+port: 5432
+statementTimeout: 5m
+`)
+	cfg, err = config.LoadFromPaths([]string{filepath.Join(dir, "port.toml"), filepath.Join(dir, "port.yaml"), "-"},
+		strings.NewReader(`{"port": 5432}`), "json")
+	if err != nil {
+		t.Fatalf("expected the same port in TOML, YAML and JSON to merge: %v", err)
+	}
+	if cfg.Port != 5432 {
+		t.Errorf("unexpected port %d", cfg.Port)
+	}
+
+	writeFile("other-port.yaml", `
+port: 5433
+`)
+	_, err = config.LoadFromPaths([]string{filepath.Join(dir, "port.toml"), filepath.Join(dir, "other-port.yaml")}, nil, "")
+	if (err == nil) || !strings.Contains(err.Error(), "conflicting values for port") {
+		t.Errorf("expected conflicting ports to fail, got %v", err)
+	}
+}
+
+func TestConfigIdentifiers(t *testing.T) {
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"my-app", true},
+		{"ReportUser", true},
+		{"select", true},
+		{"app$user", true},
+		{"Public", true},
+		{strings.Repeat("a", config.MaxIdentifierLength), true},
+		{strings.Repeat("a", config.MaxIdentifierLength+1), false},
+		{"nul\x00", false},
+		{"pg_app", false},
+		{"public", false},
+		{"none", false},
+		{"current_user", false},
+		{"session_user", false},
+		{"current_role", false},
+	}
+	for _, test := range tests {
+		for _, cfg := range []map[string]any{
+			{"users": []any{map[string]any{"name": test.name, "password": "password"}}},
+			{"groups": []any{map[string]any{"name": test.name}}},
+			{"databases": []any{map[string]any{"name": "app", "owner": test.name}}},
+		} {
+			cfg["user"] = "postgres"
+			data, err := json.Marshal(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = config.LoadFromPaths([]string{config.StdinPath}, bytes.NewReader(data), "json")
+			if (err == nil) != test.valid {
+				t.Errorf("unexpected result for %q in %s: %v", test.name, data, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,1085 @@
+package test
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ngyewch/pq-provisioner/config"
+	"github.com/ngyewch/pq-provisioner/provisioner"
+	"github.com/ngyewch/pq-provisioner/provisioner/fake"
+)
+
+// loadTestConfig loads the config that the fake tests provision.
+func loadTestConfig(t *testing.T) *config.Main {
+	cfg, err := config.LoadFromFile(filepath.Join("resources", "config", "test1.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// newFakeProvisioner returns a ConfigProvisioner for the config that connects
+// to the fake server, unless the options specify another connector. It is
+// closed when the test ends.
+func newFakeProvisioner(t *testing.T, server *fake.Server, cfg *config.Main, options ...provisioner.Option) *provisioner.ConfigProvisioner {
+	options = append([]provisioner.Option{provisioner.WithConnector(server.Connect)}, options...)
+	configProvisioner, err := provisioner.NewConfigProvisioner(t.Context(), cfg, nil, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = configProvisioner.Close()
+	})
+	return configProvisioner
+}
+
+// connectFake connects to the database of the fake server as the user. The
+// connection is closed when the test ends.
+func connectFake(t *testing.T, server *fake.Server, databaseName string, user string) provisioner.Conn {
+	conn, err := server.Connect(t.Context(), databaseName, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	return conn
+}
+
+func TestFake(t *testing.T) {
+	cfg := loadTestConfig(t)
+	server := fake.NewServer(160004)
+	configProvisioner := newFakeProvisioner(t, server, cfg)
+
+	report, err := configProvisioner.Provision(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(server.Statements()) == 0 {
+		t.Fatal("no statements executed")
+	}
+	if len(report.Actions) == 0 {
+		t.Fatal("no actions reported")
+	}
+	for _, action := range report.Actions {
+		for _, user := range cfg.Users {
+			if (user.Password != "") && strings.Contains(action.Statement, user.Password) {
+				t.Errorf("password of %s not redacted: %s", user.Name, action.Statement)
+			}
+		}
+	}
+
+	plan, err := configProvisioner.Plan(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, statement := range plan.Statements {
+		t.Errorf("unexpected statement after provisioning: %s", statement.SQL)
+	}
+}
+
+func TestFakePrune(t *testing.T) {
+	cfg := loadTestConfig(t)
+	server := fake.NewServer(160004)
+	_, err := newFakeProvisioner(t, server, cfg).Provision(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Users = cfg.Users[:2]
+	cfg.Databases[0].Users = nil
+
+	_, err = newFakeProvisioner(t, server, cfg, provisioner.WithPrune(true)).Provision(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prov, err := provisioner.NewDryRunProvisioner(t.Context(), connectFake(t, server, "postgres", "postgres"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prov.HasUser("app_user") {
+		t.Error("app_user was not dropped")
+	}
+	if !prov.HasUser("app_admin") || !prov.HasDatabase("test") {
+		t.Error("declared objects were dropped")
+	}
+}
+
+func TestFakePruneKeeps(t *testing.T) {
+	cfg := loadTestConfig(t)
+	server := fake.NewServer(160004)
+	_, err := newFakeProvisioner(t, server, cfg).Provision(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := connectFake(t, server, "postgres", "postgres")
+	for _, statement := range []string{
+		"CREATE USER legacy",
+		"CREATE USER monitor",
+		"CREATE USER rds_superuser",
+		"CREATE DATABASE admin",
+		"CREATE DATABASE rdsadmin",
+		"CREATE DATABASE locks",
+		"CREATE DATABASE legacy_db",
+		"ALTER DATABASE legacy_db OWNER TO legacy",
+	} {
+		err = conn.Exec(t.Context(), statement)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = connectFake(t, server, "test", "postgres").Exec(t.Context(), "CREATE SCHEMA legacy_schema AUTHORIZATION legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Database = "admin"
+	cfg.Lock.Database = "locks"
+	cfg.Prune.IgnoreRoles = []string{"rds*", "monitor"}
+	cfg.Prune.IgnoreDatabases = []string{"rds*"}
+	configProvisioner := newFakeProvisioner(t, server, cfg, provisioner.WithPrune(true))
+	plan, err := configProvisioner.Plan(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dropped := make([]string, 0)
+	reassigned := false
+	for _, action := range plan.Actions {
+		if strings.HasPrefix(action.Statement, "REASSIGN OWNED BY legacy ") {
+			reassigned = true
+		}
+		if action.Action != provisioner.ActionDropped {
+			continue
+		}
+		if strings.HasPrefix(action.Statement, "DROP ROLE") || strings.HasPrefix(action.Statement, "DROP DATABASE") {
+			if (action.Object == "legacy") && !reassigned {
+				t.Error("legacy dropped before its objects were reassigned")
+			}
+			dropped = append(dropped, action.Object)
+		}
+	}
+	slices.Sort(dropped)
+	if !slices.Equal(dropped, []string{"legacy", "legacy_db"}) {
+		t.Errorf("expected legacy and legacy_db dropped, got %v", dropped)
+	}
+
+	_, err = configProvisioner.Provision(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	prov, err := provisioner.NewDryRunProvisioner(t.Context(), conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prov.HasUser("legacy") || prov.HasDatabase("legacy_db") {
+		t.Error("undeclared objects were not dropped")
+	}
+	for _, databaseName := range []string{"postgres", "admin", "locks", "rdsadmin", "template0", "template1"} {
+		if !prov.HasDatabase(databaseName) {
+			t.Errorf("database %s was dropped", databaseName)
+		}
+	}
+	for _, roleName := range []string{"postgres", "monitor", "rds_superuser", "pg_monitor"} {
+		if !prov.HasUser(roleName) {
+			t.Errorf("role %s was dropped", roleName)
+		}
+	}
+	owner, err := connectFake(t, server, "test", "postgres").SchemaOwner(t.Context(), "legacy_schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner != "postgres" {
+		t.Errorf("expected legacy_schema reassigned to postgres, owned by %q", owner)
+	}
+}
+
+func TestFakePruneConnectedDatabase(t *testing.T) {
+	cfg := loadTestConfig(t)
+	server := fake.NewServer(160004)
+	err := connectFake(t, server, "postgres", "postgres").Exec(t.Context(), "CREATE DATABASE legacy_db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	connectFake(t, server, "legacy_db", "postgres")
+
+	_, err = newFakeProvisioner(t, server, cfg, provisioner.WithPrune(true)).Provision(t.Context())
+	if (err == nil) || !strings.Contains(err.Error(), "is being accessed by other users") {
+		t.Fatalf("expected pruning a database in use to fail, got %v", err)
+	}
+}
+
+func TestFakeCanceled(t *testing.T) {
+	cfg := loadTestConfig(t)
+	server := fake.NewServer(160004)
+	configProvisioner := newFakeProvisioner(t, server, cfg)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	_, err := configProvisioner.Provision(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if len(server.Statements()) > 0 {
+		t.Errorf("statements executed after cancellation: %v", server.Statements())
+	}
+}
+
+func TestFakeWait(t *testing.T) {
+	cfg := loadTestConfig(t)
+	server := fake.NewServer(160004)
+	server.SetInRecovery(true)
+
+	attempts := 0
+	connector := func(ctx context.Context, databaseName string, user string) (provisioner.Conn, error) {
+		attempts++
+		switch attempts {
+		case 1:
+			return nil, errors.New("connection refused")
+		case 3:
+			server.SetInRecovery(false)
+		}
+		return server.Connect(ctx, databaseName, user)
+	}
+
+	err := provisioner.Wait(t.Context(), cfg, nil, time.Minute, provisioner.WithConnector(connector))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts)
+	}
+
+	server.SetInRecovery(true)
+	err = provisioner.Wait(t.Context(), cfg, nil, 100*time.Millisecond, provisioner.WithConnector(server.Connect))
+	if err == nil {
+		t.Fatal("expected an error while the server is in recovery")
+	}
+}
+
+// failingConn fails the first statement executed with the prefix.
+type failingConn struct {
+	provisioner.Conn
+	prefix string
+}
+
+func (c *failingConn) Exec(ctx context.Context, query string) error {
+	if strings.HasPrefix(query, c.prefix) {
+		return errors.New("injected failure")
+	}
+	return c.Conn.Exec(ctx, query)
+}
+
+func TestFakeRollback(t *testing.T) {
+	cfg := loadTestConfig(t)
+	server := fake.NewServer(160004)
+
+	connector := func(ctx context.Context, databaseName string, user string) (provisioner.Conn, error) {
+		conn, err := server.Connect(ctx, databaseName, user)
+		if err != nil {
+			return nil, err
+		}
+		if databaseName != "test" {
+			return conn, nil
+		}
+		return &failingConn{Conn: conn, prefix: "ALTER DEFAULT PRIVILEGES"}, nil
+	}
+
+	report, err := newFakeProvisioner(t, server, cfg, provisioner.WithConnector(connector)).Provision(t.Context())
+	if err == nil {
+		t.Fatal("expected provisioning to fail")
+	}
+
+	executed := server.Statements()
+	rolledBack := 0
+	for _, action := range report.Actions {
+		switch {
+		case action.RolledBack:
+			rolledBack++
+			if action.Committed {
+				t.Errorf("rolled back action marked as committed: %s", action.Statement)
+			}
+			if (action.Error == "") && slices.Contains(executed, action.Statement) {
+				t.Errorf("rolled back statement still applied: %s", action.Statement)
+			}
+		case action.Statement != "":
+			if !action.Committed {
+				t.Errorf("statement not committed: %s", action.Statement)
+			}
+		}
+		if strings.HasPrefix(action.Statement, "CREATE DATABASE") && (action.Transaction != 0) {
+			t.Errorf("CREATE DATABASE executed in transaction %d", action.Transaction)
+		}
+	}
+	if rolledBack < 2 {
+		t.Errorf("expected the grants in the database to be rolled back, got %d rolled back actions", rolledBack)
+	}
+}
+
+func TestFakeAbortedTransaction(t *testing.T) {
+	server := fake.NewServer(160004)
+	conn := connectFake(t, server, "postgres", "postgres")
+
+	err := conn.Begin(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.Exec(t.Context(), "CREATE ROLE app_group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.Exec(t.Context(), "DROP ROLE missing")
+	if err == nil {
+		t.Fatal("expected dropping a missing role to fail")
+	}
+	err = conn.Exec(t.Context(), "CREATE ROLE other_group")
+	if err == nil {
+		t.Fatal("expected statements after a failure to be refused")
+	}
+	err = conn.Commit()
+	if err == nil {
+		t.Fatal("expected committing a failed transaction to fail")
+	}
+	if len(server.Statements()) > 0 {
+		t.Errorf("statements of the failed transaction applied: %v", server.Statements())
+	}
+
+	err = conn.Exec(t.Context(), "CREATE ROLE app_user WITH LOGIN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	userConn := connectFake(t, server, "postgres", "app_user")
+	err = userConn.Exec(t.Context(), "CREATE ROLE other_group")
+	if err == nil {
+		t.Error("expected a role without CREATEROLE to be refused")
+	}
+}
+
+func TestFakeQuoting(t *testing.T) {
+	cfg := loadTestConfig(t)
+	cfg.Users = append(cfg.Users,
+		&config.User{Name: "my-app", Password: "it's a secret"},
+		&config.User{Name: "ReportUser", Password: `back\slash`},
+		&config.User{Name: "select", Password: `both\'`},
+		&config.User{Name: "app$user", Password: "app_password"},
+	)
+	cfg.Databases = append(cfg.Databases, &config.Database{
+		Name:     "my-app",
+		Owner:    "ReportUser",
+		Users:    []*config.DatabaseUser{{Name: "select"}, {Name: "my-app"}},
+		Settings: config.Settings{"search_path": `"my-app", public`, "application_name": `it's a \`},
+	})
+	server := fake.NewServer(160004)
+	configProvisioner := newFakeProvisioner(t, server, cfg)
+	_, err := configProvisioner.Provision(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statements := strings.Join(server.Statements(), "\n")
+	for _, quoted := range []string{
+		`CREATE USER "my-app"`,
+		`CREATE USER "ReportUser"`,
+		`CREATE USER "select"`,
+		`CREATE USER "app$user"`,
+		`CREATE DATABASE "my-app"`,
+		`ALTER DATABASE "my-app" OWNER TO "ReportUser"`,
+		`ALTER DATABASE "my-app" SET search_path = 'my-app', 'public'`,
+		`ALTER DATABASE "my-app" SET application_name = E'it''s a \\'`,
+		`TO "select"`,
+	} {
+		if !strings.Contains(statements, quoted) {
+			t.Errorf("expected %s in the statements:\n%s", quoted, statements)
+		}
+	}
+
+	prov, err := provisioner.NewProvisioner(t.Context(), connectFake(t, server, "postgres", "postgres"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"my-app", "ReportUser", "select"} {
+		matches, _, err := prov.PasswordMatches(t.Context(), user, cfg.GetUser(user).Password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !matches {
+			t.Errorf("password of %s not set", user)
+		}
+	}
+
+	plan, err := configProvisioner.Plan(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, statement := range plan.Statements {
+		t.Errorf("unexpected statement after provisioning: %s", statement.SQL)
+	}
+}
+
+func TestConnectionStringQuoting(t *testing.T) {
+	tests := []struct {
+		dbname   string
+		user     string
+		password string
+		expected string
+	}{
+		{"app", "app_user", "secret", "dbname=app user=app_user password=secret host=localhost sslmode=disable"},
+		{"my app", "ReportUser", "it's", `dbname='my app' user=ReportUser password='it\'s' host=localhost sslmode=disable`},
+		{"my-app", "select", `back\slash`, `dbname=my-app user=select password='back\\slash' host=localhost sslmode=disable`},
+	}
+	for _, test := range tests {
+		connStr := provisioner.BuildConnectionString(test.dbname, test.user, test.password, "localhost", 5432, "disable")
+		if connStr != test.expected {
+			t.Errorf("expected %s, got %s", test.expected, connStr)
+		}
+	}
+}
+
+func TestFakeAbsent(t *testing.T) {
+	cfg := loadTestConfig(t)
+	cfg.Users = append(cfg.Users, &config.User{Name: "old_user", Password: "old_user_password"})
+	cfg.Databases = append(cfg.Databases, &config.Database{Name: "old_db", Owner: "old_user"})
+	cfg.Databases[0].Schemas = []*config.Schema{{Name: "legacy", Owner: "old_user"}}
+	server := fake.NewServer(160004)
+	_, err := newFakeProvisioner(t, server, cfg).Provision(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.GetUser("old_user").State = "absent"
+	cfg.Databases[0].Schemas = nil
+	cfg.Databases[1].State = "absent"
+	cfg.Databases[1].Protected = true
+	cfg.Groups = []*config.Group{{Name: "app_readers"}}
+	_, err = newFakeProvisioner(t, server, cfg).Provision(t.Context())
+	if (err == nil) || !strings.Contains(err.Error(), "database old_db is protected") {
+		t.Fatalf("expected dropping a protected database to fail, got %v", err)
+	}
+	prov, err := provisioner.NewDryRunProvisioner(t.Context(), connectFake(t, server, "postgres", "postgres"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prov.HasUser("app_readers") {
+		t.Error("groups were changed before failing")
+	}
+
+	cfg.Databases[1].Protected = false
+	_, err = newFakeProvisioner(t, server, cfg).Provision(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	prov, err = provisioner.NewDryRunProvisioner(t.Context(), connectFake(t, server, "postgres", "postgres"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if prov.HasUser("old_user") {
+		t.Error("old_user was not dropped")
+	}
+	if prov.HasDatabase("old_db") {
+		t.Error("old_db was not dropped")
+	}
+
+	conn := connectFake(t, server, "test", "postgres")
+	owner, err := conn.SchemaOwner(t.Context(), "legacy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner != "postgres" {
+		t.Errorf("expected schema legacy reassigned to postgres, owned by %q", owner)
+	}
+}
+
+func TestFakeRevokeUnlisted(t *testing.T) {
+	cfg := loadTestConfig(t)
+	server := fake.NewServer(160004)
+	_, err := newFakeProvisioner(t, server, cfg).Provision(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := connectFake(t, server, "test", "postgres")
+	for _, statement := range []string{
+		"GRANT USAGE ON SCHEMA public TO postgres",
+		"GRANT USAGE ON SCHEMA public TO app_admin",
+	} {
+		err = conn.Exec(t.Context(), statement)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg.Databases[0].Users = nil
+	_, err = newFakeProvisioner(t, server, cfg).Provision(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	grantees, err := conn.Grantees(t.Context(), "public")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(grantees, "app_user") {
+		t.Error("privileges of app_user were not revoked")
+	}
+	for _, roleName := range []string{"postgres", "app_admin"} {
+		privileges, err := conn.SchemaPrivileges(t.Context(), "public", roleName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Contains(privileges, "USAGE") {
+			t.Errorf("privileges of %s were revoked", roleName)
+		}
+	}
+}
+
+func TestFakeReadonlyProfile(t *testing.T) {
+	cfg := loadTestConfig(t)
+	server := fake.NewServer(160004)
+	_, err := newFakeProvisioner(t, server, cfg).Provision(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Databases[0].Users[0].Profile = "readonly"
+	report, err := newFakeProvisioner(t, server, cfg).Provision(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, action := range report.Actions {
+		if (action.Grantee == "app_user") && (action.Action == provisioner.ActionGranted) {
+			for _, privilege := range []string{"INSERT", "UPDATE", "DELETE", "TRUNCATE", "CREATE"} {
+				if strings.Contains(action.Statement, privilege) {
+					t.Errorf("write privilege granted to a readonly user: %s", action.Statement)
+				}
+			}
+		}
+	}
+
+	conn := connectFake(t, server, "test", "postgres")
+	for _, objectType := range []string{provisioner.ObjectTables, provisioner.ObjectSequences} {
+		privileges, err := conn.RelationPrivileges(t.Context(), objectType, "public", "app_user")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defaultPrivileges, err := conn.DefaultPrivileges(t.Context(), objectType, "public", "app_admin", "app_user")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, privilege := range slices.Concat(privileges, defaultPrivileges) {
+			if privilege != "SELECT" {
+				t.Errorf("readonly user holds %s on %s", privilege, objectType)
+			}
+		}
+	}
+	privileges, err := conn.SchemaPrivileges(t.Context(), "public", "app_user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slices.Contains(privileges, "CREATE") {
+		t.Error("readonly user holds CREATE on schema public")
+	}
+}
+
+func TestFakeExtensions(t *testing.T) {
+	cfg := loadTestConfig(t)
+	cfg.Databases[0].Extensions = []*config.Extension{{Name: "pgcrypto", Version: "1.2"}}
+	server := fake.NewServer(160004)
+	server.AddExtension("pgcrypto", "1.3", "1.2")
+	_, err := newFakeProvisioner(t, server, cfg).Provision(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := connectFake(t, server, "test", "postgres")
+	installedVersion := func() string {
+		extensions, err := conn.Extensions(t.Context())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, extension := range extensions {
+			if extension.Name == "pgcrypto" {
+				return extension.Version
+			}
+		}
+		return ""
+	}
+	if version := installedVersion(); version != "1.2" {
+		t.Errorf("expected pgcrypto 1.2 installed, got %q", version)
+	}
+
+	cfg.Databases[0].Extensions[0].Version = "1.3"
+	_, err = newFakeProvisioner(t, server, cfg).Provision(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version := installedVersion(); version != "1.3" {
+		t.Errorf("expected pgcrypto updated to 1.3, got %q", version)
+	}
+
+	cfg.Databases[0].Extensions = append(cfg.Databases[0].Extensions, &config.Extension{Name: "postgis"})
+	_, err = newFakeProvisioner(t, server, cfg).Provision(t.Context())
+	if (err == nil) || !strings.Contains(err.Error(), "extension postgis is not available on the server") {
+		t.Errorf("expected an unavailable extension to fail, got %v", err)
+	}
+}
+
+func TestFakeSettings(t *testing.T) {
+	cfg := loadTestConfig(t)
+	cfg.GetUser("app_user").Settings = config.Settings{"statement_timeout": "30s", "search_path": "app, public"}
+	cfg.Databases[0].Settings = config.Settings{"idle_in_transaction_session_timeout": "1min"}
+	cfg.Databases[0].Users[0].Settings = config.Settings{"default_transaction_read_only": "on"}
+	server := fake.NewServer(160004)
+	configProvisioner := newFakeProvisioner(t, server, cfg)
+	_, err := configProvisioner.Provision(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := connectFake(t, server, "postgres", "postgres")
+	tests := []struct {
+		databaseName string
+		roleName     string
+		expected     map[string]string
+	}{
+		{"", "app_user", map[string]string{"statement_timeout": "30s", "search_path": "app, public"}},
+		{"test", "", map[string]string{"idle_in_transaction_session_timeout": "1min"}},
+		{"test", "app_user", map[string]string{"default_transaction_read_only": "on"}},
+	}
+	for _, test := range tests {
+		settings, err := conn.Settings(t.Context(), test.databaseName, test.roleName)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !maps.Equal(settings, test.expected) {
+			t.Errorf("expected settings %v for role %q in database %q, got %v", test.expected, test.roleName, test.databaseName, settings)
+		}
+	}
+
+	plan, err := configProvisioner.Plan(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, statement := range plan.Statements {
+		t.Errorf("unexpected statement after provisioning: %s", statement.SQL)
+	}
+
+	delete(cfg.GetUser("app_user").Settings, "search_path")
+	_, err = configProvisioner.Provision(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings, err := conn.Settings(t.Context(), "", "app_user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := settings["search_path"]; ok {
+		t.Error("search_path of app_user not reset")
+	}
+}
+
+func TestFakeExport(t *testing.T) {
+	cfg := loadTestConfig(t)
+	server := fake.NewServer(160004)
+	_, err := newFakeProvisioner(t, server, cfg).Provision(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exported, err := newFakeProvisioner(t, server, cfg).Export(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, format := range config.Formats {
+		data, err := config.Marshal(exported, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := writeConfig(t, "exported."+format, string(data))
+		loaded, err := config.LoadFromFile(path)
+		if err != nil {
+			t.Fatalf("exported %s config does not load: %v", format, err)
+		}
+
+		if loaded.GetUser("postgres") != nil {
+			t.Errorf("admin user exported in %s", format)
+		}
+		for _, user := range []string{"app_admin", "app_user"} {
+			if loaded.GetUser(user) == nil {
+				t.Errorf("%s not exported in %s", user, format)
+			} else if loaded.GetUser(user).Password != "" {
+				t.Errorf("password of %s exported in %s", user, format)
+			}
+		}
+		if (len(loaded.Databases) != 1) || (loaded.Databases[0].Owner != "app_admin") ||
+			(len(loaded.Databases[0].Users) != 1) || (loaded.Databases[0].Users[0].Name != "app_user") {
+			t.Errorf("unexpected databases exported in %s: %+v", format, loaded.Databases)
+		}
+
+		plan, err := newFakeProvisioner(t, server, loaded).Plan(t.Context())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, statement := range plan.Statements {
+			t.Errorf("unexpected statement for the config exported in %s: %s", format, statement.SQL)
+		}
+	}
+}
+
+func TestFakeDatabaseOptionDrift(t *testing.T) {
+	cfg := loadTestConfig(t)
+	server := fake.NewServer(160004)
+	_, err := newFakeProvisioner(t, server, cfg).Provision(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.Databases[0].Encoding = "UTF-8"
+	cfg.Databases[0].LcCollate = "en_US.UTF-8"
+	cfg.Databases[0].LcCtype = "en_US.UTF-8"
+	cfg.Databases = append(cfg.Databases, &config.Database{Name: "test2", Owner: "app_admin", Encoding: "utf-8"})
+	_, err = newFakeProvisioner(t, server, cfg).Provision(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := newFakeProvisioner(t, server, cfg).Plan(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, drift := range plan.Drifts {
+		t.Errorf("unexpected drift: %s: %s", drift.Object, drift.Message)
+	}
+
+	cfg.Databases = cfg.Databases[:1]
+	cfg.Databases[0].Encoding = "LATIN1"
+	cfg.Databases[0].LcCollate = "de_DE.UTF-8"
+	plan, err = newFakeProvisioner(t, server, cfg).Plan(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Drifts) != 2 {
+		t.Fatalf("expected drift of encoding and lc_collate, got %+v", plan.Drifts)
+	}
+	for _, drift := range plan.Drifts {
+		if drift.Object != "database test" {
+			t.Errorf("unexpected drift: %s: %s", drift.Object, drift.Message)
+		}
+	}
+}
+
+func TestFakeUnreferencedUser(t *testing.T) {
+	cfg := loadTestConfig(t)
+	createDB := true
+	cfg.Users = append(cfg.Users, &config.User{Name: "reporting", Password: "reporting_password", CreateDB: &createDB})
+	server := fake.NewServer(160004)
+	_, err := newFakeProvisioner(t, server, cfg).Provision(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := connectFake(t, server, "postgres", "postgres")
+	roles, err := conn.Roles(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (roles["reporting"] == nil) || !roles["reporting"].CreateDB {
+		t.Fatalf("reporting not created with CREATEDB: %+v", roles["reporting"])
+	}
+
+	createDB = false
+	_, err = newFakeProvisioner(t, server, cfg).Provision(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	roles, err = conn.Roles(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if roles["reporting"].CreateDB {
+		t.Error("CREATEDB of reporting not revoked")
+	}
+}
+
+func TestFakeReconcilePasswordsOfCreatedUsers(t *testing.T) {
+	cfg := loadTestConfig(t)
+	server := fake.NewServer(160004)
+	plan, err := newFakeProvisioner(t, server, cfg, provisioner.WithReconcilePasswords(true)).Plan(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	passwords := make(map[string]int)
+	for _, action := range plan.Actions {
+		if strings.Contains(action.Statement, "PASSWORD") {
+			passwords[action.Object]++
+		}
+	}
+	for _, user := range []string{"app_admin", "app_user"} {
+		if passwords[user] != 1 {
+			t.Errorf("expected the password of %s set once, got %d", user, passwords[user])
+		}
+	}
+}
+
+func TestFakeReconcilePasswordsWithoutSuperuser(t *testing.T) {
+	cfg := loadTestConfig(t)
+	server := fake.NewServer(160004)
+	_, err := newFakeProvisioner(t, server, cfg).Provision(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := connectFake(t, server, "postgres", "postgres")
+	for _, statement := range []string{
+		"CREATE ROLE provisioner WITH LOGIN CREATEROLE CREATEDB",
+		"GRANT app_admin TO provisioner WITH ADMIN OPTION",
+		"GRANT app_user TO provisioner WITH ADMIN OPTION",
+	} {
+		err = conn.Exec(t.Context(), statement)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg.User = "provisioner"
+	cfg.Database = "postgres"
+	cfg.Users = slices.DeleteFunc(cfg.Users, func(user *config.User) bool {
+		return user.Name == "postgres"
+	})
+	cfg.GetUser("app_admin").Password = "new_app_admin_password"
+	cfg.GetUser("app_user").Password = "new_app_user_password"
+	report, err := newFakeProvisioner(t, server, cfg, provisioner.WithReconcilePasswords(true)).Provision(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	altered := 0
+	for _, action := range report.Actions {
+		if strings.Contains(action.Statement, "PASSWORD") {
+			altered++
+		}
+	}
+	if altered != 2 {
+		t.Errorf("expected 2 passwords re-applied, got %d", altered)
+	}
+
+	prov, err := provisioner.NewProvisioner(t.Context(), conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range []string{"app_admin", "app_user"} {
+		matches, _, err := prov.PasswordMatches(t.Context(), user, cfg.GetUser(user).Password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !matches {
+			t.Errorf("password of %s not changed", user)
+		}
+	}
+}
+
+func TestFakeGroupsWithoutSuperuser(t *testing.T) {
+	cfg := loadTestConfig(t)
+	server := fake.NewServer(160004)
+	_, err := newFakeProvisioner(t, server, cfg).Provision(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn := connectFake(t, server, "postgres", "postgres")
+	for _, statement := range []string{
+		"CREATE ROLE provisioner WITH LOGIN CREATEROLE CREATEDB",
+		"GRANT app_admin TO provisioner WITH ADMIN OPTION",
+		"GRANT app_user TO provisioner WITH ADMIN OPTION",
+	} {
+		err = conn.Exec(t.Context(), statement)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg.User = "provisioner"
+	cfg.Database = "postgres"
+	cfg.Users = slices.DeleteFunc(cfg.Users, func(user *config.User) bool {
+		return user.Name == "postgres"
+	})
+	cfg.Groups = []*config.Group{
+		{
+			Name:    "app_readers",
+			Members: []*config.Member{{Name: "app_user"}},
+		},
+	}
+	configProvisioner := newFakeProvisioner(t, server, cfg)
+	_, err = configProvisioner.Provision(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	memberships, err := conn.Memberships(t.Context(), "app_readers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.ContainsFunc(memberships, func(membership *provisioner.Membership) bool {
+		return (membership.Member == "provisioner") && membership.Admin
+	}) {
+		t.Error("membership of the admin user in app_readers was revoked")
+	}
+
+	plan, err := configProvisioner.Plan(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, statement := range plan.Statements {
+		t.Errorf("unexpected statement after provisioning: %s", statement.SQL)
+	}
+}
+
+func TestFakeAdminWithoutPrivilegesOfOwner(t *testing.T) {
+	cfg := loadTestConfig(t)
+	server := fake.NewServer(160004)
+	_, err := newFakeProvisioner(t, server, cfg).Provision(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = connectFake(t, server, "postgres", "postgres").Exec(t.Context(), "CREATE ROLE provisioner WITH LOGIN CREATEROLE CREATEDB")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg.User = "provisioner"
+	cfg.Database = "postgres"
+	cfg.Users = slices.DeleteFunc(cfg.Users, func(user *config.User) bool {
+		return user.Name == "postgres"
+	})
+	_, err = newFakeProvisioner(t, server, cfg).Provision(t.Context())
+	if (err == nil) || !strings.Contains(err.Error(), "must be a superuser or inherit from app_admin") {
+		t.Fatalf("expected an error about the privileges of app_admin, got %v", err)
+	}
+}
+
+func TestFakeLock(t *testing.T) {
+	cfg := loadTestConfig(t)
+	cfg.Lock.Timeout = 10 * time.Millisecond
+	server := fake.NewServer(160004)
+	configProvisioner := newFakeProvisioner(t, server, cfg)
+
+	conn := connectFake(t, server, "postgres", "postgres")
+	locked, err := conn.TryAdvisoryLock(t.Context(), provisioner.DefaultLockKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked {
+		t.Fatal("lock not taken")
+	}
+
+	_, err = configProvisioner.Provision(t.Context())
+	if !errors.Is(err, provisioner.ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+	if len(server.Statements()) > 0 {
+		t.Errorf("statements executed without the lock: %v", server.Statements())
+	}
+
+	err = conn.AdvisoryUnlock(t.Context(), provisioner.DefaultLockKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = configProvisioner.Provision(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	locked, err = conn.TryAdvisoryLock(t.Context(), provisioner.DefaultLockKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked {
+		t.Error("lock not released after the run")
+	}
+}
+
+func TestFakeLockDatabase(t *testing.T) {
+	cfg := loadTestConfig(t)
+	cfg.Database = "template1"
+	cfg.Lock.Database = "postgres"
+	cfg.Lock.Timeout = -1
+	server := fake.NewServer(160004)
+
+	conn := connectFake(t, server, "postgres", "postgres")
+	locked, err := conn.TryAdvisoryLock(t.Context(), provisioner.DefaultLockKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !locked {
+		t.Fatal("lock not taken")
+	}
+
+	_, err = newFakeProvisioner(t, server, cfg).Provision(t.Context())
+	if !errors.Is(err, provisioner.ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+
+	// Without a lock database, the lock is taken in the admin database.
+	cfg.Lock.Database = ""
+	_, err = newFakeProvisioner(t, server, cfg).Provision(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFakeSCRAMPasswords(t *testing.T) {
+	cfg := loadTestConfig(t)
+	verifier, err := provisioner.SCRAMVerifier("app_user_secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.GetUser("app_user").Password = verifier
+
+	server := fake.NewServer(160004)
+	_, err = newFakeProvisioner(t, server, cfg).Provision(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, statement := range server.Statements() {
+		if strings.Contains(statement, "app_admin_password") {
+			t.Errorf("cleartext password sent: %s", statement)
+		}
+	}
+
+	conn := connectFake(t, server, "postgres", "postgres")
+	stored, err := conn.PasswordVerifier(t.Context(), "app_user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored != verifier {
+		t.Errorf("verifier not stored as given: %s", stored)
+	}
+	stored, err = conn.PasswordVerifier(t.Context(), "app_admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(stored, "SCRAM-SHA-256$") {
+		t.Errorf("expected a SCRAM-SHA-256 verifier, got %s", stored)
+	}
+
+	prov, err := provisioner.NewProvisioner(t.Context(), conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches, _, err := prov.PasswordMatches(t.Context(), "app_admin", "app_admin_password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !matches {
+		t.Error("computed verifier does not match the password")
+	}
+	err = prov.SetPassword(t.Context(), "app_user", "md5d41d8cd98f00b204e9800998ecf8427e")
+	if err == nil {
+		t.Error("expected an MD5 verifier to be refused")
+	}
+}
@@ -0,0 +1,106 @@
+package test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ngyewch/pq-provisioner/config"
+	"github.com/ngyewch/pq-provisioner/provisioner"
+	"github.com/ngyewch/pq-provisioner/provisioner/fake"
+)
+
+func TestPasswordSources(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	err := os.WriteFile(passwordFile, []byte("from-file\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PQ_TEST_PASSWORD", " from-env ")
+	provisioner.RegisterPasswordProvider("test", provisioner.PasswordProviderFunc(func(ctx context.Context, ref string) (string, error) {
+		return "from-" + ref, nil
+	}))
+
+	untrimmed := false
+	tests := []struct {
+		user     config.User
+		expected string
+	}{
+		{user: config.User{Name: "literal", Password: " literal "}, expected: " literal "},
+		{user: config.User{Name: "file", PasswordFile: passwordFile}, expected: "from-file"},
+		{user: config.User{Name: "env", PasswordEnv: "PQ_TEST_PASSWORD"}, expected: "from-env"},
+		{user: config.User{Name: "untrimmed", PasswordEnv: "PQ_TEST_PASSWORD", TrimPassword: &untrimmed}, expected: " from-env "},
+		{user: config.User{Name: "command", PasswordCommand: "echo from-command"}, expected: "from-command"},
+		{user: config.User{Name: "registered", PasswordFrom: "test:provider"}, expected: "from-provider"},
+	}
+	for _, test := range tests {
+		password, err := provisioner.ResolvePassword(t.Context(), &test.user)
+		if err != nil {
+			t.Errorf("%s: %v", test.user.Name, err)
+			continue
+		}
+		if password != test.expected {
+			t.Errorf("%s: got %q, expected %q", test.user.Name, password, test.expected)
+		}
+	}
+
+	for _, user := range []config.User{
+		{Name: "missing", PasswordFile: filepath.Join(t.TempDir(), "missing")},
+		{Name: "unset", PasswordEnv: "PQ_TEST_UNSET"},
+		{Name: "failing", PasswordCommand: "exit 1"},
+		{Name: "unregistered", PasswordFrom: "unregistered:ref"},
+	} {
+		_, err := provisioner.ResolvePassword(t.Context(), &user)
+		if err == nil {
+			t.Errorf("%s: expected an error", user.Name)
+		}
+	}
+}
+
+func TestFakePasswordFile(t *testing.T) {
+	cfg, err := config.LoadFromFile(filepath.Join("resources", "config", "test1.toml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	err = os.WriteFile(passwordFile, []byte("app_user_secret\n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	user := cfg.GetUser("app_user")
+	user.Password = ""
+	user.PasswordFile = passwordFile
+
+	server := fake.NewServer(160004)
+
+	configProvisioner, err := provisioner.NewConfigProvisioner(t.Context(), cfg, nil,
+		provisioner.WithConnector(server.Connect),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := configProvisioner.Provision(t.Context())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, action := range report.Actions {
+		if strings.Contains(action.Statement, "app_user_secret") {
+			t.Errorf("password not redacted: %s", action.Statement)
+		}
+	}
+
+	conn := connectFake(t, server, "postgres", "postgres")
+	prov, err := provisioner.NewDryRunProvisioner(t.Context(), conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches, _, err := prov.PasswordMatches(t.Context(), "app_user", "app_user_secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !matches {
+		t.Error("password read from file was not set")
+	}
+}
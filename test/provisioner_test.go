@@ -41,14 +41,17 @@ func Test1(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	time.Sleep(10 * time.Second)
+	err = provisioner.Wait(t.Context(), cfg, nil, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-	configProvisioner, err := provisioner.NewConfigProvisioner(cfg, nil)
+	configProvisioner, err := provisioner.NewConfigProvisioner(t.Context(), cfg, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = configProvisioner.Provision()
+	_, err = configProvisioner.Provision(t.Context())
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -108,20 +111,23 @@ func Test2(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	time.Sleep(10 * time.Second)
-
 	userSettings := &ssh_config.UserSettings{}
 	userSettings.ConfigFinder(func() string {
 		return filepath.Join("resources", "ssh_config", "test2")
 	})
 	sshClientFactory := ssh_helper.NewSSHClientFactory(userSettings)
 
-	configProvisioner, err := provisioner.NewConfigProvisioner(cfg, sshClientFactory)
+	err = provisioner.Wait(t.Context(), cfg, sshClientFactory, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	configProvisioner, err := provisioner.NewConfigProvisioner(t.Context(), cfg, sshClientFactory)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	err = configProvisioner.Provision()
+	_, err = configProvisioner.Provision(t.Context())
 	if err != nil {
 		t.Fatal(err)
 	}